@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/backup"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/dnsprovider"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/server"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+const timeoutFlagUsage = "how long to wait for OPNsense"
+
+// openProvider reads the configuration and creates the provider the same way serve does,
+// waiting until it logged in to every target if connect is set
+func openProvider(ctx context.Context, o *options, connect bool) (provider.Provider, error) {
+	config, err := configuration.Load(o.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration: %w", err)
+	}
+
+	p, err := dnsprovider.Init(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if connect {
+		if err := dnsprovider.WaitConnected(ctx, p); err != nil {
+			dnsprovider.Close(p)
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// list prints the records the webhook manages, as external-dns sees them
+func list(o *options, args []string) error {
+	fs := o.flagSet("list", "list [flags]")
+	output := fs.String("output", "table", "output format, one of table, json or yaml")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	if *output != "table" && *output != "json" && *output != "yaml" {
+		return fmt.Errorf("unknown output format '%s', must be one of table, json or yaml", *output)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, true)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	records, err := p.Records(ctx)
+	if err != nil {
+		return err
+	}
+
+	return printRecords(os.Stdout, *output, records)
+}
+
+func printRecords(w io.Writer, output string, records []*endpoint.Endpoint) error {
+	if records == nil {
+		records = []*endpoint.Endpoint{}
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "yaml":
+		// Go through JSON so the keys are the same as in the webhook API
+		b, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		return yaml.NewEncoder(w).Encode(v)
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tTARGETS")
+		for _, r := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.DNSName, r.RecordType, strings.Join(r.Targets, ","))
+		}
+		return tw.Flush()
+	}
+}
+
+// apply applies a plan of changes in the format external-dns posts to the webhook
+func apply(o *options, args []string) error {
+	fs := o.flagSet("apply", "apply [flags] <changes.json|->")
+	overrideLimits := fs.Bool("override-delete-limits", false, "apply the changes even if they exceed the deletion safety limits")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the file holding the changes, or - for stdin")
+	}
+
+	changes, err := readChanges(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, true)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	applyCtx := ctx
+	if *overrideLimits {
+		applyCtx = opnsense.WithDeleteLimitsOverride(ctx)
+	}
+	if err := p.ApplyChanges(applyCtx, changes); err != nil {
+		return err
+	}
+
+	fmt.Printf("applied %d creates, %d updates and %d deletes\n", len(changes.Create), len(changes.UpdateNew), len(changes.Delete))
+	return nil
+}
+
+func readChanges(file string) (*plan.Changes, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var changes plan.Changes
+	if err := dec.Decode(&changes); err != nil {
+		return nil, fmt.Errorf("decoding changes: %w", err)
+	}
+	return &changes, nil
+}
+
+// backupRecords writes the records the webhook manages to a file, or stdout
+func backupRecords(o *options, args []string) error {
+	fs := o.flagSet("backup", "backup [flags]")
+	output := fs.String("output", "-", "file to write the backup to, - for stdout")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, true)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	b, ok := p.(*opnsense.Provider)
+	if !ok {
+		return fmt.Errorf("the provider doesn't support backups")
+	}
+
+	records, err := b.Backup(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return backup.Write(os.Stdout, records)
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if err := backup.Write(f, records); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restore recreates the records missing from or changed in OPNsense since a backup
+func restore(o *options, args []string) error {
+	fs := o.flagSet("restore", "restore [flags] <backup.json|->")
+	dryRun := fs.Bool("dry-run", false, "only print what would be restored")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the backup file, or - for stdin")
+	}
+
+	records, err := backup.Read(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, true)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	r, ok := p.(*opnsense.Provider)
+	if !ok {
+		return fmt.Errorf("the provider doesn't support restoring backups")
+	}
+
+	changes, err := r.Restore(ctx, records, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("every record and alias of the backup is in place, nothing to restore")
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if *dryRun {
+		fmt.Printf("dry run, %d records and aliases would be restored\n", len(changes))
+	} else {
+		fmt.Printf("restored %d records and aliases\n", len(changes))
+	}
+	return nil
+}
+
+// adopt marks unmanaged records as owned by the webhook. The flags narrow the records
+// selected by the configured domain filters and ownership marker
+func adopt(o *options, args []string) error {
+	fs := o.flagSet("adopt", "adopt [flags]")
+	domains := fs.String("domain", "", "comma-separated domains to adopt records of, matched like DOMAIN_FILTER")
+	regex := fs.String("regex", "", "regular expression the names of the records to adopt have to match")
+	description := fs.String("description", "", "regular expression the descriptions of the records to adopt have to match")
+	dryRun := fs.Bool("dry-run", false, "only print what would be adopted")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	var selector opnsense.AdoptSelector
+	if *domains != "" {
+		selector.Domains = strings.Split(*domains, ",")
+	}
+	if *regex != "" {
+		re, err := regexp.Compile(*regex)
+		if err != nil {
+			return fmt.Errorf("invalid --regex: %w", err)
+		}
+		selector.Regex = re
+	}
+	if *description != "" {
+		re, err := regexp.Compile(*description)
+		if err != nil {
+			return fmt.Errorf("invalid --description: %w", err)
+		}
+		selector.Description = re
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, true)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	a, ok := p.(*opnsense.Provider)
+	if !ok {
+		return fmt.Errorf("the provider doesn't support adopting records")
+	}
+
+	changes, err := a.Adopt(ctx, selector, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("no unmanaged records match, nothing to adopt")
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if *dryRun {
+		fmt.Printf("dry run, %d records would be adopted\n", len(changes))
+	} else {
+		fmt.Printf("adopted %d records\n", len(changes))
+	}
+	return nil
+}
+
+// check verifies the credentials and privileges on every host without changing anything
+func check(o *options, args []string) error {
+	fs := o.flagSet("check", "check [flags]")
+	timeout := fs.Duration("timeout", 30*time.Second, timeoutFlagUsage)
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	p, err := openProvider(ctx, o, false)
+	if err != nil {
+		return err
+	}
+	defer dnsprovider.Close(p)
+
+	checker, ok := p.(*opnsense.Provider)
+	if !ok {
+		return fmt.Errorf("the provider doesn't support checks")
+	}
+
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tHOST\tCHECK\tRESULT")
+	for _, result := range checker.Check(ctx) {
+		outcome := "ok"
+		if result.Err != nil {
+			outcome = "failed: " + result.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Target, result.Host, result.Check, outcome)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// validateConfig checks the configuration without starting the webhook or contacting OPNsense
+func validateConfig(o *options, args []string) error {
+	o.flagSet("validate-config", "validate-config [flags]").Parse(args)
+
+	config, err := configuration.Load(o.configFile)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	settings, err := dnsprovider.Load(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	if err := errors.Join(server.Validate(config), dnsprovider.Validate(settings)); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	fmt.Println("configuration is valid")
+	return nil
+}
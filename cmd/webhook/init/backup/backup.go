@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	filePrefix = "opnsense-backup-"
+	fileSuffix = ".json"
+	// timeFormat sorts lexically in chronological order
+	timeFormat = "20060102T150405Z"
+)
+
+var lastBackupSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "opnsense_webhook",
+	Name:      "last_backup_success_timestamp_seconds",
+	Help:      "Unix time of the last successful periodic backup.",
+})
+
+// backuper is implemented by providers that can back up the records they manage
+type backuper interface {
+	Backup(ctx context.Context) (*opnsense.Backup, error)
+}
+
+// Write writes a backup as indented JSON
+func Write(w io.Writer, backup *opnsense.Backup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(backup)
+}
+
+// Read reads a backup file, "-" reads it from stdin
+func Read(path string) (*opnsense.Backup, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	backup, err := opnsense.DecodeBackup(r)
+	if err != nil {
+		return nil, fmt.Errorf("decoding backup: %w", err)
+	}
+	return backup, nil
+}
+
+// Save writes a backup into dir, named after its creation time, and removes
+// the oldest backups beyond keep. A keep of zero keeps every backup.
+func Save(dir string, backup *opnsense.Backup, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, filePrefix+backup.CreatedAt.UTC().Format(timeFormat)+fileSuffix)
+	tmp, err := os.CreateTemp(dir, ".tmp-"+filePrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := Write(tmp, backup); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	// Renaming makes sure a backup file is never seen half written
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	if keep > 0 {
+		if err := prune(dir, keep); err != nil {
+			return path, fmt.Errorf("removing old backups: %w", err)
+		}
+	}
+	return path, nil
+}
+
+func prune(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filePrefix) && strings.HasSuffix(e.Name(), fileSuffix) {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	slices.Sort(backups)
+	for _, name := range backups[:len(backups)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start backs up the records of the provider served by hook into BACKUP_DIR
+// every BACKUP_INTERVAL until ctx is done. It does nothing if either isn't set.
+func Start(ctx context.Context, config configuration.Config, hook *webhook.Webhook) {
+	if config.BackupDir == "" || config.BackupInterval <= 0 {
+		return
+	}
+
+	log.Infof("backup: backing up managed records to %s every %s", config.BackupDir, config.BackupInterval)
+	go func() {
+		ticker := time.NewTicker(config.BackupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := run(ctx, config, hook); err != nil {
+				log.Errorf("backup: periodic backup failed: %v", err)
+			}
+		}
+	}()
+}
+
+func run(ctx context.Context, config configuration.Config, hook *webhook.Webhook) error {
+	b, ok := hook.Provider().(backuper)
+	if !ok {
+		return fmt.Errorf("the provider doesn't support backups")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.BackupInterval)
+	defer cancel()
+
+	backup, err := b.Backup(ctx)
+	if err != nil {
+		return err
+	}
+
+	path, err := Save(config.BackupDir, backup, config.BackupKeep)
+	if err != nil {
+		return err
+	}
+
+	lastBackupSuccess.SetToCurrentTime()
+	log.Infof("backup: wrote %s", path)
+	return nil
+}
@@ -1,6 +1,8 @@
 package configuration
 
 import (
+	"os"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v11"
@@ -9,21 +11,87 @@ import (
 
 // Config struct for configuration environmental variables
 type Config struct {
-	ServerHost           string        `env:"SERVER_HOST" envDefault:"localhost"`
-	ServerPort           int           `env:"SERVER_PORT" envDefault:"8888"`
-	ServerReadTimeout    time.Duration `env:"SERVER_READ_TIMEOUT"`
-	ServerWriteTimeout   time.Duration `env:"SERVER_WRITE_TIMEOUT"`
-	DomainFilter         []string      `env:"DOMAIN_FILTER" envDefault:""`
-	ExcludeDomains       []string      `env:"EXCLUDE_DOMAIN_FILTER" envDefault:""`
-	RegexDomainFilter    string        `env:"REGEXP_DOMAIN_FILTER" envDefault:""`
-	RegexDomainExclusion string        `env:"REGEXP_DOMAIN_FILTER_EXCLUSION" envDefault:""`
+	ServerHost            string        `env:"SERVER_HOST" envDefault:"localhost" yaml:"serverHost"`
+	ServerPort            int           `env:"SERVER_PORT" envDefault:"8888" yaml:"serverPort"`
+	ServerSocket          string        `env:"SERVER_SOCKET" yaml:"serverSocket"`
+	ServerReadTimeout     time.Duration `env:"SERVER_READ_TIMEOUT" yaml:"serverReadTimeout"`
+	ServerWriteTimeout    time.Duration `env:"SERVER_WRITE_TIMEOUT" yaml:"serverWriteTimeout"`
+	ServerAuthToken       string        `env:"SERVER_AUTH_TOKEN" yaml:"serverAuthToken"`
+	ServerAuthTokenFile   string        `env:"SERVER_AUTH_TOKEN_FILE" yaml:"serverAuthTokenFile"`
+	ServerTLSCertFile     string        `env:"SERVER_TLS_CERT_FILE" yaml:"serverTLSCertFile"`
+	ServerTLSKeyFile      string        `env:"SERVER_TLS_KEY_FILE" yaml:"serverTLSKeyFile"`
+	ServerTLSClientCAFile string        `env:"SERVER_TLS_CLIENT_CA_FILE" yaml:"serverTLSClientCAFile"`
+	HealthHost            string        `env:"HEALTH_HOST" envDefault:"0.0.0.0" yaml:"healthHost"`
+	HealthPort            int           `env:"HEALTH_PORT" envDefault:"8080" yaml:"healthPort"`
+	MetricsHost           string        `env:"METRICS_HOST" envDefault:"0.0.0.0" yaml:"metricsHost"`
+	MetricsPort           int           `env:"METRICS_PORT" yaml:"metricsPort"`
+	HealthTLSCertFile     string        `env:"HEALTH_TLS_CERT_FILE" yaml:"healthTLSCertFile"`
+	HealthTLSKeyFile      string        `env:"HEALTH_TLS_KEY_FILE" yaml:"healthTLSKeyFile"`
+	TLSMinVersion         string        `env:"TLS_MIN_VERSION" envDefault:"1.2" yaml:"tlsMinVersion"`
+	TLSCipherSuites       []string      `env:"TLS_CIPHER_SUITES" envDefault:"" yaml:"tlsCipherSuites"`
+	DriftEndpoint         bool          `env:"DRIFT_ENDPOINT" envDefault:"false" yaml:"driftEndpoint"`
+	BackupDir             string        `env:"BACKUP_DIR" yaml:"backupDir"`
+	BackupInterval        time.Duration `env:"BACKUP_INTERVAL" yaml:"backupInterval"`
+	BackupKeep            int           `env:"BACKUP_KEEP" envDefault:"10" yaml:"backupKeep"`
+	DomainFilterConfig    `yaml:"domainFilter"`
+	Targets               []string `env:"OPNSENSE_TARGETS" envDefault:"" yaml:"-"`
+
+	// File is the configuration file the configuration was read from, if any
+	File string
+	// Environment holds the settings of the configuration file overridden by the
+	// environmental variables, the remaining settings are read from it as well
+	Environment map[string]string
+}
+
+// DomainFilterConfig struct for the domain filter environmental variables
+type DomainFilterConfig struct {
+	DomainFilter         []string `env:"DOMAIN_FILTER" envDefault:"" yaml:"domains"`
+	ExcludeDomains       []string `env:"EXCLUDE_DOMAIN_FILTER" envDefault:"" yaml:"excludeDomains"`
+	RegexDomainFilter    string   `env:"REGEXP_DOMAIN_FILTER" envDefault:"" yaml:"regex"`
+	RegexDomainExclusion string   `env:"REGEXP_DOMAIN_FILTER_EXCLUSION" envDefault:"" yaml:"regexExclusion"`
 }
 
-// Init sets up configuration by reading set environmental variables
-func Init() Config {
-	cfg := Config{}
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatalf("error reading configuration from environment: %v", err)
+// Init sets up configuration by reading the configuration file, if any, and set environmental variables
+func Init(file string) Config {
+	cfg, err := Load(file)
+	if err != nil {
+		log.Fatalf("error reading configuration: %v", err)
 	}
 	return cfg
 }
+
+// Load reads the configuration from file, if set, and the environmental variables,
+// which take precedence over the file
+func Load(file string) (Config, error) {
+	environment := make(map[string]string)
+	if file != "" {
+		fileEnv, err := readFile(file)
+		if err != nil {
+			return Config{}, err
+		}
+		environment = fileEnv
+	}
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			environment[key] = value
+		}
+	}
+
+	cfg := Config{File: file, Environment: environment}
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environment}); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// TargetEnvPrefix returns the prefix of the environmental variables of a target,
+// e.g. SITE_A_ for the target site-a
+func TargetEnvPrefix(name string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+	return prefix + "_"
+}
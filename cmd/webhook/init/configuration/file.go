@@ -0,0 +1,221 @@
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"gopkg.in/yaml.v3"
+)
+
+// fileDecoder turns a configuration file into the environmental variables its settings stand for,
+// so file and environment are parsed alike and environmental variables can override the file
+type fileDecoder struct {
+	path string
+	env  map[string]string
+	errs []error
+}
+
+// readFile reads a YAML or JSON configuration file. Every key is validated,
+// unknown ones are reported along with their line.
+func readFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	d := &fileDecoder{path: path, env: make(map[string]string)}
+	if len(root.Content) > 0 {
+		d.root(root.Content[0])
+	}
+	if len(d.errs) > 0 {
+		return nil, errors.Join(d.errs...)
+	}
+	return d.env, nil
+}
+
+func (d *fileDecoder) errorf(node *yaml.Node, format string, args ...any) {
+	d.errs = append(d.errs, fmt.Errorf("%s:%d: %s", d.path, node.Line, fmt.Sprintf(format, args...)))
+}
+
+// root decodes the top level, which holds the settings of Config
+// and the sections of the opnsense provider and its targets
+func (d *fileDecoder) root(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		d.errorf(node, "expected a mapping of settings")
+		return
+	}
+
+	var targets, singleTarget *yaml.Node
+	d.mapping(node, "", func(key, value *yaml.Node) bool {
+		switch key.Value {
+		case "provider":
+			d.section(value, key.Value, "", reflect.TypeOf(opnsense.ProviderConfig{}))
+		case "opnsense":
+			singleTarget = key
+			d.section(value, key.Value, "", reflect.TypeOf(opnsense.Config{}))
+		case "targets":
+			targets = key
+			d.targets(value)
+		default:
+			return d.field(key, value, "", "", reflect.TypeOf(Config{}))
+		}
+		return true
+	})
+
+	if targets != nil && singleTarget != nil {
+		d.errorf(singleTarget, "'opnsense' can't be combined with 'targets', configure the opnsense settings of every target instead")
+	}
+}
+
+// targets decodes the list of named targets, each with its own domain filter and opnsense settings
+func (d *fileDecoder) targets(node *yaml.Node) {
+	if node.Kind != yaml.SequenceNode {
+		d.errorf(node, "targets: expected a list of targets")
+		return
+	}
+
+	var names []string
+	for i, target := range node.Content {
+		path := fmt.Sprintf("targets[%d]", i)
+		if target.Kind != yaml.MappingNode {
+			d.errorf(target, "%s: expected a mapping", path)
+			continue
+		}
+
+		var name string
+		for j := 0; j+1 < len(target.Content); j += 2 {
+			if target.Content[j].Value == "name" {
+				name = target.Content[j+1].Value
+			}
+		}
+		if name == "" {
+			d.errorf(target, "%s: name is required", path)
+			continue
+		}
+		names = append(names, name)
+
+		prefix := TargetEnvPrefix(name)
+		d.mapping(target, path, func(key, value *yaml.Node) bool {
+			switch key.Value {
+			case "name":
+			case "domainFilter":
+				d.section(value, path+".domainFilter", prefix, reflect.TypeOf(DomainFilterConfig{}))
+			case "opnsense":
+				d.section(value, path+".opnsense", prefix, reflect.TypeOf(opnsense.Config{}))
+			default:
+				return false
+			}
+			return true
+		})
+	}
+	d.env["OPNSENSE_TARGETS"] = strings.Join(names, ",")
+}
+
+// section decodes a mapping into the settings of the struct type t
+func (d *fileDecoder) section(node *yaml.Node, path, prefix string, t reflect.Type) {
+	if node.Kind != yaml.MappingNode {
+		d.errorf(node, "%s: expected a mapping", path)
+		return
+	}
+	d.mapping(node, path, func(key, value *yaml.Node) bool {
+		return d.field(key, value, path, prefix, t)
+	})
+}
+
+// field decodes the setting of t named by key, returning false if t has no such setting.
+// Only fields with a yaml name are settings, and only sections or fields read from the
+// environment, so fields filled in by the webhook itself, e.g. File, can't be set.
+func (d *fileDecoder) field(key, value *yaml.Node, path, prefix string, t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		yamlName, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if yamlName == "" || yamlName == "-" || yamlName != key.Value {
+			continue
+		}
+
+		if f.Type.Kind() == reflect.Struct {
+			d.section(value, joinPath(path, key.Value), prefix, f.Type)
+			return true
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		if v, ok := d.value(value, joinPath(path, key.Value), listSeparator(f)); ok {
+			d.env[prefix+name] = v
+		}
+		return true
+	}
+	return false
+}
+
+// mapping calls fn for every key of a mapping, reporting the keys fn doesn't know and duplicates
+func (d *fileDecoder) mapping(node *yaml.Node, path string, fn func(key, value *yaml.Node) bool) {
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if seen[key.Value] {
+			d.errorf(key, "duplicate key '%s'", joinPath(path, key.Value))
+			continue
+		}
+		seen[key.Value] = true
+
+		if !fn(key, value) {
+			d.errorf(key, "unknown key '%s'", joinPath(path, key.Value))
+		}
+	}
+}
+
+// value converts a scalar or a list of scalars into the text of an environmental variable,
+// joining lists with separator. A null value leaves the setting unset.
+func (d *fileDecoder) value(node *yaml.Node, path, separator string) (string, bool) {
+	switch {
+	case node.Kind == yaml.ScalarNode && node.Tag == "!!null":
+		return "", false
+	case node.Kind == yaml.ScalarNode:
+		return node.Value, true
+	case node.Kind == yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				d.errorf(item, "%s: expected a list of values", path)
+				return "", false
+			}
+			// The list is joined and split again, so an item holding the separator would silently become two
+			if strings.Contains(item.Value, separator) {
+				d.errorf(item, "%s: list items can't contain '%s'", path, separator)
+				return "", false
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, separator), true
+	default:
+		d.errorf(node, "%s: expected a value or a list of values", path)
+		return "", false
+	}
+}
+
+// listSeparator is the separator the environmental variable of a list setting is split on.
+func listSeparator(f reflect.StructField) string {
+	if separator := f.Tag.Get("envSeparator"); separator != "" {
+		return separator
+	}
+	return ","
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,71 @@
+package configuration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadFileRejectsListItemsHoldingTheSeparator(t *testing.T) {
+	path := writeConfig(t, `provider:
+  notify:
+    urls:
+      - https://hooks.example.com/a
+      - https://hooks.example.com/b?x=1,2
+`)
+	_, err := readFile(path)
+	if err == nil {
+		t.Fatal("readFile succeeded, want an error")
+	}
+	if want := path + ":5: provider.notify.urls: list items can't contain ','"; !strings.Contains(err.Error(), want) {
+		t.Errorf("readFile error = %q, want it to contain %q", err, want)
+	}
+}
+
+func TestReadFileJoinsListsWithTheirSeparator(t *testing.T) {
+	path := writeConfig(t, `domainFilter:
+  domains: [a.example.com, b.example.com]
+provider:
+  protectedRecords:
+    - /^nas[0-9]{1,3}\./
+    - router.example.com
+`)
+	env, err := readFile(path)
+	if err != nil {
+		t.Fatalf("readFile: %v", err)
+	}
+	if got, want := env["DOMAIN_FILTER"], "a.example.com,b.example.com"; got != want {
+		t.Errorf("DOMAIN_FILTER = %q, want %q", got, want)
+	}
+	if got, want := env["OPNSENSE_PROTECTED_RECORDS"], `/^nas[0-9]{1,3}\./;router.example.com`; got != want {
+		t.Errorf("OPNSENSE_PROTECTED_RECORDS = %q, want %q", got, want)
+	}
+}
+
+func TestReadFileRejectsFieldsThatAreNoSettings(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		key     string
+	}{
+		// File and Environment have no yaml name, they are filled in by the webhook
+		{content: "\"\": /etc/webhook/other.yaml\n", key: "''"},
+		{content: "File: /etc/webhook/other.yaml\n", key: "'File'"},
+		{content: "Environment:\n  OPNSENSE_API_KEY: key\n", key: "'Environment'"},
+		{content: "environment:\n  OPNSENSE_API_KEY: key\n", key: "'environment'"},
+	} {
+		_, err := readFile(writeConfig(t, tc.content))
+		if err == nil || !strings.Contains(err.Error(), "unknown key "+tc.key) {
+			t.Errorf("readFile(%q) = %v, want an unknown key %s", tc.content, err, tc.key)
+		}
+	}
+}
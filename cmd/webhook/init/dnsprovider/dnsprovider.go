@@ -1,54 +1,207 @@
 package dnsprovider
 
 import (
+	"errors"
 	"fmt"
-	"regexp"
+	"os"
 	"strings"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
-	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/provider"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type OpnsenseProviderFactory func(baseProvider *provider.BaseProvider, opnsenseConfig *opnsense.Config) provider.Provider
 
+// Settings is everything the provider is built from, as read from the environment
+type Settings struct {
+	DomainFilter configuration.DomainFilterConfig
+	Provider     opnsense.ProviderConfig
+	Targets      []TargetSettings
+}
+
+// TargetSettings are the settings of a single opnsense target
+type TargetSettings struct {
+	Name         string
+	DomainFilter configuration.DomainFilterConfig
+	Config       opnsense.Config
+}
+
+// Init reads the provider settings and creates the provider from them
 func Init(config configuration.Config) (provider.Provider, error) {
-	var domainFilter endpoint.DomainFilter
-	createMsg := "creating opnsense provider with "
+	settings, err := Load(config)
+	if err != nil {
+		return nil, err
+	}
+	return New(settings)
+}
+
+// Load reads the provider settings from the environment of config, including credentials kept in files
+func Load(config configuration.Config) (*Settings, error) {
+	settings := &Settings{DomainFilter: config.DomainFilterConfig}
+	if err := env.ParseWithOptions(&settings.Provider, env.Options{Environment: config.Environment}); err != nil {
+		return nil, fmt.Errorf("reading opnsense provider configuration failed: %v", err)
+	}
+	if err := readNotifyFiles(&settings.Provider.Notify); err != nil {
+		return nil, fmt.Errorf("reading opnsense provider configuration failed: %v", err)
+	}
+
+	if len(config.Targets) == 0 {
+		opnsenseConfig := opnsense.Config{}
+		if err := env.ParseWithOptions(&opnsenseConfig, env.Options{Environment: config.Environment}); err != nil {
+			return nil, fmt.Errorf("reading opnsense configuration failed: %v", err)
+		}
+		if err := readCredentials(&opnsenseConfig, ""); err != nil {
+			return nil, fmt.Errorf("reading opnsense configuration failed: %v", err)
+		}
+
+		settings.Targets = []TargetSettings{
+			{Name: opnsense.DefaultTargetName, DomainFilter: config.DomainFilterConfig, Config: opnsenseConfig},
+		}
+		return settings, nil
+	}
+
+	if err := validateTargetNames(config.Targets); err != nil {
+		return nil, err
+	}
+	for _, name := range config.Targets {
+		opts := env.Options{Prefix: configuration.TargetEnvPrefix(name), Environment: config.Environment}
+
+		filterConfig := configuration.DomainFilterConfig{}
+		if err := env.ParseWithOptions(&filterConfig, opts); err != nil {
+			return nil, fmt.Errorf("reading domain filter of target '%s' failed: %v", name, err)
+		}
+
+		opnsenseConfig := opnsense.Config{}
+		if err := env.ParseWithOptions(&opnsenseConfig, opts); err != nil {
+			return nil, fmt.Errorf("reading opnsense configuration of target '%s' failed: %v", name, err)
+		}
+		if err := readCredentials(&opnsenseConfig, opts.Prefix); err != nil {
+			return nil, fmt.Errorf("reading opnsense configuration of target '%s' failed: %v", name, err)
+		}
+
+		settings.Targets = append(settings.Targets, TargetSettings{
+			Name:         name,
+			DomainFilter: filterConfig,
+			Config:       opnsenseConfig,
+		})
+	}
+
+	return settings, nil
+}
 
-	if config.RegexDomainFilter != "" {
-		createMsg += fmt.Sprintf("regexp domain filter: '%s', ", config.RegexDomainFilter)
-		if config.RegexDomainExclusion != "" {
-			createMsg += fmt.Sprintf("with exclusion: '%s', ", config.RegexDomainExclusion)
+// validateTargetNames rejects target names that would share their settings with another target
+func validateTargetNames(names []string) error {
+	prefixes := make(map[string]string, len(names))
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("OPNSENSE_TARGETS holds an empty target name")
 		}
-		domainFilter = endpoint.NewRegexDomainFilter(
-			regexp.MustCompile(config.RegexDomainFilter),
-			regexp.MustCompile(config.RegexDomainExclusion),
-		)
-	} else {
-		if config.DomainFilter != nil && len(config.DomainFilter) > 0 {
-			createMsg += fmt.Sprintf("domain filter: '%s', ", strings.Join(config.DomainFilter, ","))
+		if name == opnsense.DefaultTargetName {
+			return fmt.Errorf("target name '%s' is reserved for the single target configured without OPNSENSE_TARGETS", name)
 		}
-		if config.ExcludeDomains != nil && len(config.ExcludeDomains) > 0 {
-			createMsg += fmt.Sprintf("exclude domain filter: '%s', ", strings.Join(config.ExcludeDomains, ","))
+
+		prefix := configuration.TargetEnvPrefix(name)
+		if other, ok := prefixes[prefix]; ok {
+			if other == name {
+				return fmt.Errorf("target '%s' is configured twice", name)
+			}
+			return fmt.Errorf("targets '%s' and '%s' would both read their settings from %s variables", other, name, prefix+"*")
+		}
+		prefixes[prefix] = name
+	}
+	return nil
+}
+
+// New creates the provider from its settings
+func New(settings *Settings) (provider.Provider, error) {
+	domainFilter, err := newDomainFilter("creating opnsense provider with ", "", settings.DomainFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]opnsense.Target, 0, len(settings.Targets))
+	for _, t := range settings.Targets {
+		targetFilter := domainFilter
+		if t.Name != opnsense.DefaultTargetName {
+			targetFilter, err = newDomainFilter(fmt.Sprintf("adding opnsense target '%s' with ", t.Name), configuration.TargetEnvPrefix(t.Name), t.DomainFilter)
+			if err != nil {
+				return nil, err
+			}
 		}
-		domainFilter = endpoint.NewDomainFilterWithExclusions(config.DomainFilter, config.ExcludeDomains)
+
+		config := t.Config
+		targets = append(targets, opnsense.Target{
+			Name:         t.Name,
+			DomainFilter: targetFilter,
+			Config:       &config,
+		})
 	}
 
-	createMsg = strings.TrimSuffix(createMsg, ", ")
-	if strings.HasSuffix(createMsg, "with ") {
-		createMsg += "no kind of domain filters"
+	providerConfig := settings.Provider
+	return opnsense.NewOpnsenseProvider(domainFilter, &providerConfig, targets)
+}
+
+// Validate reports provider settings that can't work, without connecting to any target
+func Validate(settings *Settings) error {
+	errs := []error{
+		validateDomainFilter("", settings.DomainFilter),
+		validateAnnotationFilter(settings.Provider.AnnotationFilter),
+		settings.Provider.Validate(),
+	}
+	for _, t := range settings.Targets {
+		if t.Name != opnsense.DefaultTargetName {
+			errs = append(errs, validateDomainFilter(configuration.TargetEnvPrefix(t.Name), t.DomainFilter))
+		}
+		if err := t.Config.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("target '%s': %w", t.Name, err))
+		}
 	}
-	log.Info(createMsg)
+	return errors.Join(errs...)
+}
 
-	opnsenseConfig := opnsense.Config{}
-	if err := env.Parse(&opnsenseConfig); err != nil {
-		return nil, fmt.Errorf("reading opnsense configuration failed: %v", err)
+// readCredentials reads the api key and secret from their files, if set.
+// Files are re-read on every reload, so rotated Kubernetes secrets are picked up.
+func readCredentials(config *opnsense.Config, prefix string) error {
+	for _, c := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{name: prefix + "OPNSENSE_API_KEY", value: &config.Key, file: config.KeyFile},
+		{name: prefix + "OPNSENSE_API_SECRET", value: &config.Secret, file: config.SecretFile},
+	} {
+		if c.file != "" {
+			b, err := os.ReadFile(c.file)
+			if err != nil {
+				return fmt.Errorf("reading %s_FILE: %w", c.name, err)
+			}
+			*c.value = strings.TrimSpace(string(b))
+		}
+		if *c.value == "" {
+			return fmt.Errorf("either %s or %s_FILE must be set", c.name, c.name)
+		}
 	}
+	return nil
+}
 
-	return opnsense.NewOpnsenseProvider(domainFilter, &opnsenseConfig)
+// readNotifyFiles reads the notification template and secret from their files, if set.
+func readNotifyFiles(config *notify.Config) error {
+	if config.TemplateFile != "" {
+		b, err := os.ReadFile(config.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("reading NOTIFY_TEMPLATE_FILE: %w", err)
+		}
+		config.Template = string(b)
+	}
+	if config.SecretFile != "" {
+		b, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return fmt.Errorf("reading NOTIFY_SECRET_FILE: %w", err)
+		}
+		config.Secret = strings.TrimSpace(string(b))
+	}
+	return nil
 }
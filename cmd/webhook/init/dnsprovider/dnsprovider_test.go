@@ -0,0 +1,54 @@
+package dnsprovider
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+)
+
+func targetsConfig(names ...string) configuration.Config {
+	environment := make(map[string]string)
+	for _, name := range names {
+		prefix := configuration.TargetEnvPrefix(name)
+		environment[prefix+"OPNSENSE_HOST"] = "https://192.168.1.1"
+		environment[prefix+"OPNSENSE_API_KEY"] = "key"
+		environment[prefix+"OPNSENSE_API_SECRET"] = "secret"
+	}
+	return configuration.Config{Targets: names, Environment: environment}
+}
+
+func TestLoadRejectsConflictingTargetNames(t *testing.T) {
+	for _, tc := range []struct {
+		names []string
+		want  string
+	}{
+		{names: []string{"default", "site-b"}, want: "reserved"},
+		{names: []string{"site-a", "site-a"}, want: "configured twice"},
+		{names: []string{"site-a", "site_a"}, want: "would both read their settings from SITE_A_*"},
+		{names: []string{"site-a", ""}, want: "empty target name"},
+	} {
+		t.Run(strings.Join(tc.names, ","), func(t *testing.T) {
+			_, err := Load(targetsConfig(tc.names...))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadReadsEveryTarget(t *testing.T) {
+	config := targetsConfig("site-a", "site-b")
+	config.Environment["SITE_B_DOMAIN_FILTER"] = "b.example.com"
+
+	settings, err := Load(config)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(settings.Targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(settings.Targets))
+	}
+	if got := settings.Targets[1].DomainFilter.DomainFilter; len(got) != 1 || got[0] != "b.example.com" {
+		t.Errorf("domain filter of site-b = %v, want [b.example.com]", got)
+	}
+}
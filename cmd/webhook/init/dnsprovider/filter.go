@@ -0,0 +1,152 @@
+package dnsprovider
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/external-dns/endpoint"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FilterError describes a filter setting that can't work
+type FilterError struct {
+	// Setting is the environmental variable holding the filter, including the target prefix
+	Setting string
+	Value   string
+	Reason  string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%s '%s': %s", e.Setting, e.Value, e.Reason)
+}
+
+// validateDomainFilter reports every problem of a domain filter configuration.
+// prefix is the prefix of the target's environmental variables, if any.
+func validateDomainFilter(prefix string, config configuration.DomainFilterConfig) error {
+	var errs []error
+	filterError := func(setting, value, format string, args ...any) {
+		errs = append(errs, &FilterError{Setting: prefix + setting, Value: value, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{name: "REGEXP_DOMAIN_FILTER", value: config.RegexDomainFilter},
+		{name: "REGEXP_DOMAIN_FILTER_EXCLUSION", value: config.RegexDomainExclusion},
+	} {
+		if _, err := regexp.Compile(setting.value); err != nil {
+			filterError(setting.name, setting.value, "invalid regular expression: %v", err)
+		}
+	}
+
+	regexConfigured := config.RegexDomainFilter != "" || config.RegexDomainExclusion != ""
+	for _, setting := range []struct {
+		name    string
+		domains []string
+	}{
+		{name: "DOMAIN_FILTER", domains: config.DomainFilter},
+		{name: "EXCLUDE_DOMAIN_FILTER", domains: config.ExcludeDomains},
+	} {
+		value := strings.Join(setting.domains, ",")
+		if regexConfigured && len(nonEmpty(setting.domains)) > 0 {
+			filterError(setting.name, value, "can't be combined with the regexp domain filters, which would take precedence")
+		}
+		for _, domain := range setting.domains {
+			if strings.Contains(domain, "*") {
+				filterError(setting.name, value, "wildcards aren't supported, '%s' already matches its subdomains and '.%s' only matches its subdomains", strings.TrimPrefix(domain, "*."), strings.TrimPrefix(domain, "*."))
+			} else if strings.ContainsAny(domain, " /:") {
+				filterError(setting.name, value, "'%s' is not a domain name", domain)
+			}
+		}
+	}
+
+	if config.RegexDomainFilter != "" && config.RegexDomainFilter == config.RegexDomainExclusion {
+		filterError("REGEXP_DOMAIN_FILTER_EXCLUSION", config.RegexDomainExclusion, "excludes every domain included by %sREGEXP_DOMAIN_FILTER, nothing would be managed", prefix)
+	}
+
+	if includes := nonEmpty(config.DomainFilter); len(includes) > 0 && len(nonEmpty(config.ExcludeDomains)) > 0 {
+		exclusions := endpoint.NewDomainFilter(config.ExcludeDomains)
+		covered := true
+		for _, include := range includes {
+			// Includes starting with a dot only match subdomains, so check one of those
+			name := include
+			if strings.HasPrefix(include, ".") {
+				name = "sub" + include
+			}
+			if !exclusions.Match(name) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			filterError("EXCLUDE_DOMAIN_FILTER", strings.Join(config.ExcludeDomains, ","), "excludes every domain included by %sDOMAIN_FILTER, nothing would be managed", prefix)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAnnotationFilter reports an annotation filter that isn't a valid label selector
+func validateAnnotationFilter(filter string) error {
+	if _, err := labels.Parse(filter); err != nil {
+		return &FilterError{Setting: "ANNOTATION_FILTER", Value: filter, Reason: err.Error()}
+	}
+	return nil
+}
+
+// newDomainFilter validates a domain filter configuration, builds the domain filter and logs it, prefixed by createMsg
+func newDomainFilter(createMsg, prefix string, config configuration.DomainFilterConfig) (endpoint.DomainFilter, error) {
+	if err := validateDomainFilter(prefix, config); err != nil {
+		return endpoint.DomainFilter{}, err
+	}
+
+	var domainFilter endpoint.DomainFilter
+
+	if config.RegexDomainFilter != "" || config.RegexDomainExclusion != "" {
+		var include, exclude *regexp.Regexp
+		if config.RegexDomainFilter != "" {
+			createMsg += fmt.Sprintf("regexp domain filter: '%s', ", config.RegexDomainFilter)
+			include = regexp.MustCompile(config.RegexDomainFilter)
+		}
+		if config.RegexDomainExclusion != "" {
+			createMsg += fmt.Sprintf("with exclusion: '%s', ", config.RegexDomainExclusion)
+			exclude = regexp.MustCompile(config.RegexDomainExclusion)
+			if include != nil {
+				log.Warnf("%sREGEXP_DOMAIN_FILTER is ignored while %sREGEXP_DOMAIN_FILTER_EXCLUSION is set, every domain not excluded is managed", prefix, prefix)
+			}
+		}
+		domainFilter = endpoint.NewRegexDomainFilter(include, exclude)
+	} else {
+		if len(config.DomainFilter) > 0 {
+			createMsg += fmt.Sprintf("domain filter: '%s', ", strings.Join(config.DomainFilter, ","))
+		}
+		if len(config.ExcludeDomains) > 0 {
+			createMsg += fmt.Sprintf("exclude domain filter: '%s', ", strings.Join(config.ExcludeDomains, ","))
+		}
+		domainFilter = endpoint.NewDomainFilterWithExclusions(config.DomainFilter, config.ExcludeDomains)
+	}
+
+	createMsg = strings.TrimSuffix(createMsg, ", ")
+	if strings.HasSuffix(createMsg, "with ") {
+		createMsg += "no kind of domain filters"
+	}
+	log.Info(createMsg)
+
+	return domainFilter, nil
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,293 @@
+package dnsprovider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
+	"sigs.k8s.io/external-dns/provider"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadConnectTimeout is how long a reloaded provider may take to log in before it is discarded
+const reloadConnectTimeout = 30 * time.Second
+
+// secretSettings are never logged, only whether they changed
+var secretSettings = []string{"OPNSENSE_API_KEY", "OPNSENSE_API_SECRET", "NOTIFY_SECRET", "SERVER_AUTH_TOKEN"}
+
+// recordSettings select the records managed on every target besides the domain filters,
+// the state built from the records of the previous provider is dropped when they change
+var recordSettings = []string{"OPNSENSE_OWNERSHIP_MARKER", "OPNSENSE_PROTECTED_RECORDS"}
+
+// urlSettings are logged with the scheme and host of their URLs only, chat webhooks carry their token in the path
+var urlSettings = []string{"NOTIFY_URLS"}
+
+// connectWaiter is implemented by providers that log in to their backend in the background
+type connectWaiter interface {
+	WaitConnected(ctx context.Context) error
+}
+
+// WaitConnected blocks until p logged in to its backend, if it does so in the background
+func WaitConnected(ctx context.Context, p provider.Provider) error {
+	if waiter, ok := p.(connectWaiter); ok {
+		return waiter.WaitConnected(ctx)
+	}
+	return nil
+}
+
+// inheritor is implemented by providers that can take over the state of the provider they replace
+type inheritor interface {
+	Inherit(previous provider.Provider, targets []string) bool
+}
+
+// Reloader rebuilds the provider of a webhook from fresh settings
+type Reloader struct {
+	webhook  *webhook.Webhook
+	config   configuration.Config
+	settings *Settings
+}
+
+// NewReloader creates a reloader for a webhook serving a provider built from settings,
+// which were read from config. The settings of config served by the webhook itself,
+// like its listeners, TLS and authentication, can't be reloaded.
+func NewReloader(webhook *webhook.Webhook, config configuration.Config, settings *Settings) *Reloader {
+	return &Reloader{webhook: webhook, config: config, settings: settings}
+}
+
+// Reload reads the settings again and swaps a provider built from them into the webhook
+// once it logged in. Requests already being served finish on the previous provider.
+// If anything fails, or ctx is cancelled before the new provider logged in, the previous provider keeps serving.
+// Reload must not be called again before it returned.
+func (r *Reloader) Reload(ctx context.Context) error {
+	config, err := configuration.Load(r.config.File)
+	if err != nil {
+		return fmt.Errorf("reading configuration: %w", err)
+	}
+
+	settings, err := Load(config)
+	if err != nil {
+		return err
+	}
+
+	// Compared against the configuration the webhook started with, they stay pending until a restart
+	for _, change := range diffServerSettings(r.config, config) {
+		log.Warnf("reload: %s, which only takes effect after a restart", change)
+	}
+
+	changes := diffSettings(r.settings, settings)
+	if len(changes) == 0 {
+		log.Info("reload: provider settings unchanged, keeping the current provider")
+		return nil
+	}
+	for _, change := range changes {
+		log.Infof("reload: %s", change)
+	}
+
+	p, err := New(settings)
+	if err != nil {
+		return err
+	}
+
+	// Only swap in a provider that can actually serve, wrong credentials must not take the webhook down
+	connectCtx, cancel := context.WithTimeout(ctx, reloadConnectTimeout)
+	defer cancel()
+	err = WaitConnected(connectCtx, p)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		Close(p)
+		if ctx.Err() != nil {
+			return fmt.Errorf("reload cancelled: %w", ctx.Err())
+		}
+		return fmt.Errorf("reloaded provider didn't connect within %s: %w", reloadConnectTimeout, err)
+	}
+
+	r.inherit(p, settings)
+	previous := r.webhook.SetProvider(p)
+	r.settings = settings
+	if err := Close(previous); err != nil {
+		log.Warnf("reload: closing the previous provider failed: %v", err)
+	}
+
+	log.Info("reload: provider replaced")
+	return nil
+}
+
+// inherit carries the state of the current provider over to p, as far as the records it covers
+// are selected alike by the current and the new settings, and logs what starts over
+func (r *Reloader) inherit(p provider.Provider, settings *Settings) {
+	heir, ok := p.(inheritor)
+	if !ok {
+		return
+	}
+
+	targets := unchangedTargets(r.settings, settings)
+	if heir.Inherit(r.webhook.Provider(), targets) {
+		log.Info("reload: carried over the record cache, the outcome of the last sync and the drift baseline")
+		return
+	}
+
+	log.Info("reload: the record cache and the outcome of the last sync start over")
+	for _, t := range settings.Targets {
+		if !slices.Contains(targets, t.Name) {
+			log.Infof("reload: the drift baseline of target '%s' starts over, the records it covers changed", t.Name)
+		}
+	}
+}
+
+// unchangedTargets returns the names of the targets whose records are selected alike by the old and updated settings,
+// which are kept on the same firewalls
+func unchangedTargets(old, updated *Settings) []string {
+	if !reflect.DeepEqual(old.DomainFilter, updated.DomainFilter) {
+		return nil
+	}
+	before, after := flattenSettings(old), flattenSettings(updated)
+	for _, name := range recordSettings {
+		if before[name] != after[name] {
+			return nil
+		}
+	}
+
+	var targets []string
+	for _, t := range updated.Targets {
+		i := slices.IndexFunc(old.Targets, func(o TargetSettings) bool { return o.Name == t.Name })
+		// Credentials and the like may change, the records stay the same as long as the firewalls do
+		if i >= 0 && reflect.DeepEqual(old.Targets[i].DomainFilter, t.DomainFilter) && slices.Equal(old.Targets[i].Config.Hosts, t.Config.Hosts) {
+			targets = append(targets, t.Name)
+		}
+	}
+	return targets
+}
+
+// Close stops the background work of p, if it has any
+func Close(p provider.Provider) error {
+	if closer, ok := p.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// diffSettings describes every setting that differs between the old and new settings, sorted by name
+func diffSettings(old, updated *Settings) []string {
+	before, after := flattenSettings(old), flattenSettings(updated)
+
+	var changes []string
+	for name, value := range after {
+		previous, ok := before[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s set to %s", name, describeSetting(name, value)))
+		case previous != value:
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", name, describeSetting(name, previous), describeSetting(name, value)))
+		}
+	}
+	for name, value := range before {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, fmt.Sprintf("%s removed, was %s", name, describeSetting(name, value)))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+// diffServerSettings describes every setting served by the webhook itself that differs between the old and updated configuration
+func diffServerSettings(old, updated configuration.Config) []string {
+	before, after := flattenServerSettings(old), flattenServerSettings(updated)
+
+	var changes []string
+	for name, value := range after {
+		if previous := before[name]; previous != value {
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", name, describeSetting(name, previous), describeSetting(name, value)))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+func describeSetting(name, value string) string {
+	for _, secret := range secretSettings {
+		if strings.HasSuffix(name, secret) {
+			return "<redacted>"
+		}
+	}
+	if slices.Contains(urlSettings, name) && value != "" {
+		urls := strings.Split(value, ",")
+		for i, u := range urls {
+			urls[i] = notify.RedactURL(u)
+		}
+		return fmt.Sprintf("'%s'", strings.Join(urls, ","))
+	}
+	return fmt.Sprintf("'%s'", value)
+}
+
+// flattenSettings keys every setting by the environmental variable it is read from
+func flattenSettings(settings *Settings) map[string]string {
+	flat := make(map[string]string)
+	flattenStruct(flat, "", settings.DomainFilter)
+	flattenStruct(flat, "", settings.Provider)
+	for _, t := range settings.Targets {
+		prefix := ""
+		if t.Name != opnsense.DefaultTargetName {
+			prefix = configuration.TargetEnvPrefix(t.Name)
+			flattenStruct(flat, prefix, t.DomainFilter)
+		}
+		flattenStruct(flat, prefix, t.Config)
+	}
+	return flat
+}
+
+// flattenServerSettings keys the settings of config that aren't provider settings by their environmental variable
+func flattenServerSettings(config configuration.Config) map[string]string {
+	flat := make(map[string]string)
+	flattenStruct(flat, "", config)
+
+	providerSettings := make(map[string]string)
+	flattenStruct(providerSettings, "", config.DomainFilterConfig)
+	for name := range providerSettings {
+		delete(flat, name)
+	}
+	delete(flat, "OPNSENSE_TARGETS")
+	return flat
+}
+
+func flattenStruct(flat map[string]string, prefix string, v any) {
+	value := reflect.ValueOf(v)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("env"), ",")
+		if name == "" {
+			// Nested settings like the notifications are parsed without a prefix of their own
+			if field.Kind() == reflect.Struct {
+				flattenStruct(flat, prefix, field.Interface())
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Slice {
+			parts := make([]string, field.Len())
+			for j := range parts {
+				parts[j] = fmt.Sprint(field.Index(j).Interface())
+			}
+			separator := value.Type().Field(i).Tag.Get("envSeparator")
+			if separator == "" {
+				separator = ","
+			}
+			flat[prefix+name] = strings.Join(parts, separator)
+			continue
+		}
+		flat[prefix+name] = fmt.Sprint(field.Interface())
+	}
+}
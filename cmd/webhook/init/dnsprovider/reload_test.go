@@ -0,0 +1,140 @@
+package dnsprovider
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestDiffSettingsRedactsSecretsAndNotifyURLs(t *testing.T) {
+	old := &Settings{}
+	updated := &Settings{}
+	updated.Provider.Notify = notify.Config{
+		URLs:   []string{"https://hooks.slack.com/services/T000/B000/TOKEN", "https://matrix.example.com/hook/abc123?x=1"},
+		Secret: "s3cret",
+	}
+
+	changes := strings.Join(diffSettings(old, updated), "\n")
+	for _, leaked := range []string{"TOKEN", "abc123", "s3cret", "/services/"} {
+		if strings.Contains(changes, leaked) {
+			t.Errorf("the logged changes contain %q:\n%s", leaked, changes)
+		}
+	}
+	for _, want := range []string{
+		"NOTIFY_URLS changed from '' to 'https://hooks.slack.com,https://matrix.example.com'",
+		"NOTIFY_SECRET changed from <redacted> to <redacted>",
+	} {
+		if !strings.Contains(changes, want) {
+			t.Errorf("the logged changes lack %q:\n%s", want, changes)
+		}
+	}
+}
+
+func TestDiffServerSettingsIgnoresProviderSettings(t *testing.T) {
+	old := configuration.Config{ServerPort: 8888, ServerAuthToken: "t0ken"}
+	updated := configuration.Config{ServerPort: 9999, ServerAuthToken: "n3w", Targets: []string{"site-a"}}
+	updated.DomainFilter = []string{"example.com"}
+
+	changes := diffServerSettings(old, updated)
+	want := []string{
+		"SERVER_AUTH_TOKEN changed from <redacted> to <redacted>",
+		"SERVER_PORT changed from '8888' to '9999'",
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("diffServerSettings = %q, want %q", changes, want)
+	}
+}
+
+func TestUnchangedTargets(t *testing.T) {
+	old, err := Load(targetsConfig("site-a", "site-b"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(config configuration.Config) configuration.Config
+		want   []string
+	}{
+		{
+			name: "credentials",
+			change: func(config configuration.Config) configuration.Config {
+				config.Environment["SITE_A_OPNSENSE_API_SECRET"] = "rotated"
+				return config
+			},
+			want: []string{"site-a", "site-b"},
+		},
+		{
+			name: "hosts",
+			change: func(config configuration.Config) configuration.Config {
+				config.Environment["SITE_A_OPNSENSE_HOST"] = "https://192.168.2.1"
+				return config
+			},
+			want: []string{"site-b"},
+		},
+		{
+			name: "target domain filter",
+			change: func(config configuration.Config) configuration.Config {
+				config.Environment["SITE_B_DOMAIN_FILTER"] = "b.example.com"
+				return config
+			},
+			want: []string{"site-a"},
+		},
+		{
+			name: "ownership marker",
+			change: func(config configuration.Config) configuration.Config {
+				config.Environment["OPNSENSE_OWNERSHIP_MARKER"] = "external-dns"
+				return config
+			},
+		},
+		{
+			name: "global domain filter",
+			change: func(config configuration.Config) configuration.Config {
+				config.DomainFilter = []string{"example.com"}
+				return config
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			updated, err := Load(tc.change(targetsConfig("site-a", "site-b")))
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := unchangedTargets(old, updated); !slices.Equal(got, tc.want) {
+				t.Errorf("unchangedTargets = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsTheProviderWhenCancelled(t *testing.T) {
+	// The reloaded provider can't log in, so the reload waits until it is cancelled
+	t.Setenv("OPNSENSE_HOST", "http://127.0.0.1:1")
+	t.Setenv("OPNSENSE_API_KEY", "key")
+	t.Setenv("OPNSENSE_API_SECRET", "secret")
+
+	current, err := opnsense.NewOpnsenseProvider(endpoint.DomainFilter{}, &opnsense.ProviderConfig{ProtectedAction: opnsense.ProtectedActionSkip},
+		[]opnsense.Target{{Name: opnsense.DefaultTargetName, Backend: opnsense.NewMemoryBackend()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close(current) })
+	hook := webhook.New(current)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewReloader(hook, configuration.Config{}, &Settings{}).Reload(ctx)
+	if err == nil || !strings.Contains(err.Error(), "reload cancelled") {
+		t.Errorf("Reload = %v, want it to be cancelled", err)
+	}
+	if hook.Provider() != current {
+		t.Error("the cancelled reload replaced the provider")
+	}
+}
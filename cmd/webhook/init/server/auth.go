@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+)
+
+// authToken returns the bearer token clients have to present, read from
+// SERVER_AUTH_TOKEN_FILE if set, or an empty string if token authentication is disabled
+func authToken(config configuration.Config) (string, error) {
+	if config.ServerAuthTokenFile == "" {
+		return config.ServerAuthToken, nil
+	}
+
+	b, err := os.ReadFile(config.ServerAuthTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading auth token file: %w", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("auth token file '%s' is empty", config.ServerAuthTokenFile)
+	}
+	return token, nil
+}
+
+// bearerAuth rejects requests that don't carry token in their Authorization header
+func bearerAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				requestid.Log(r.Context()).Warnf("rejecting unauthenticated request, request method: %s, request path: %s", r.Method, r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="external-dns-opnsense-webhook"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DriftReporter is implemented by providers that check their records for changes made outside of the webhook
+type DriftReporter interface {
+	Drift() opnsense.DriftReport
+}
+
+// DriftHandler returns the outcome of the last drift check as JSON
+func DriftHandler(p *webhook.Webhook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reporter, ok := p.Provider().(DriftReporter)
+		if !ok {
+			http.Error(w, "the provider doesn't support drift detection", http.StatusNotImplemented)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reporter.Drift()); err != nil {
+			log.Errorf("error writing drift response: %v", err)
+		}
+	}
+}
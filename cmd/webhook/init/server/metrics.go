@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	webhookRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "opnsense_webhook",
+		Name:      "http_requests_total",
+		Help:      "Requests to the webhook endpoints by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	webhookRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "opnsense_webhook",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of requests to the webhook endpoints by endpoint, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method", "code"})
+)
+
+// instrument counts and times the requests to a webhook endpoint
+func instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"endpoint": endpoint}
+	return promhttp.InstrumentHandlerCounter(
+		webhookRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(
+			webhookRequestDuration.MustCurryWith(labels),
+			handler,
+		),
+	)
+}
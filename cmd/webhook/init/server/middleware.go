@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"github.com/go-chi/chi/v5/middleware"
+	log "github.com/sirupsen/logrus"
+)
+
+// spanName names the server span of a webhook request after its method and path
+func spanName(_ string, r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// requestLogger logs every request once it was served, along with its request ID,
+// status, duration and the number of bytes read and written
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		entry := requestid.Log(r.Context()).WithFields(log.Fields{
+			"requestMethod": r.Method,
+			"requestPath":   r.URL.Path,
+			"remoteAddr":    r.RemoteAddr,
+			"status":        status,
+			"duration":      time.Since(start).String(),
+			"bytesIn":       body.n,
+			"bytesOut":      ww.BytesWritten(),
+		})
+		if status >= http.StatusInternalServerError {
+			entry.Warn("request served")
+			return
+		}
+		entry.Info("request served")
+	})
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// cacheControl lets clients bypass the record cache by sending "Cache-Control: no-cache"
+func cacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache") {
+			r = r.WithContext(opnsense.WithCacheBypass(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,64 +2,190 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// HealthCheckHandler returns the status of the service
+// HealthCheckHandler returns the status of the service.
+// It only tells whether the process is alive and never checks any backend.
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
-// ReadinessHandler returns whether the service is ready to accept requests
-func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+// ReadinessChecker is implemented by providers that can report on the
+// backends they depend on. Checks maps a check name to its last error.
+type ReadinessChecker interface {
+	Ready(ctx context.Context) (ready bool, checks map[string]error)
+}
+
+type readinessCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                    `json:"status"`
+	Checks map[string]readinessCheck `json:"checks,omitempty"`
+}
+
+// ReadinessHandler returns whether the service is ready to accept requests,
+// along with the outcome of every check as JSON
+func ReadinessHandler(p *webhook.Webhook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, checks := true, map[string]error(nil)
+		if checker, ok := p.Provider().(ReadinessChecker); ok {
+			ready, checks = checker.Ready(r.Context())
+		}
+
+		response := readinessResponse{Status: "ready", Checks: make(map[string]readinessCheck, len(checks))}
+		for name, err := range checks {
+			if err != nil {
+				response.Checks[name] = readinessCheck{Status: "failing", Error: err.Error()}
+				continue
+			}
+			response.Checks[name] = readinessCheck{Status: "ok"}
+		}
+
+		status := http.StatusOK
+		if !ready {
+			response.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("error writing readiness response: %v", err)
+		}
+	}
 }
 
-// Init initializes the http server
-func Init(config configuration.Config, p *webhook.Webhook) (*http.Server, *http.Server) {
+// Validate reports server settings that can't work, e.g. unreadable certificates
+func Validate(config configuration.Config) error {
+	if _, err := authToken(config); err != nil {
+		return fmt.Errorf("authentication: %w", err)
+	}
+	if _, err := mainTLSConfig(config); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if _, err := healthTLSConfig(config); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+// Init initializes and starts the http servers: the webhook, the health server
+// and, if it has a port of its own, the metrics server
+func Init(config configuration.Config, p *webhook.Webhook) []*http.Server {
+	token, err := authToken(config)
+	if err != nil {
+		log.Fatalf("error setting up authentication: %v", err)
+	}
+	tlsConfig, err := mainTLSConfig(config)
+	if err != nil {
+		log.Fatalf("error setting up tls: %v", err)
+	}
+	healthTLS, err := healthTLSConfig(config)
+	if err != nil {
+		log.Fatalf("error setting up tls: %v", err)
+	}
+
 	mainRouter := chi.NewRouter()
-	mainRouter.Get("/", p.Negotiate)
-	mainRouter.Get("/records", p.Records)
-	mainRouter.Post("/records", p.ApplyChanges)
-	mainRouter.Post("/adjustendpoints", p.AdjustEndpoints)
+	mainRouter.Use(otelhttp.NewMiddleware("webhook", otelhttp.WithSpanNameFormatter(spanName)))
+	mainRouter.Use(requestid.Middleware)
+	mainRouter.Use(requestLogger)
+	if token != "" {
+		log.Info("requiring a bearer token on the webhook endpoints")
+		mainRouter.Use(bearerAuth(token))
+	}
+	mainRouter.Use(cacheControl)
+	mainRouter.Get("/", instrument("negotiate", p.Negotiate))
+	mainRouter.Get("/records", instrument("records", p.Records))
+	mainRouter.Post("/records", instrument("apply_changes", p.ApplyChanges))
+	mainRouter.Post("/adjustendpoints", instrument("adjust_endpoints", p.AdjustEndpoints))
 
 	mainServer := createHTTPServer(fmt.Sprintf("%s:%d", config.ServerHost, config.ServerPort), mainRouter, config.ServerReadTimeout, config.ServerWriteTimeout)
-	go func() {
-		log.Infof("starting server on addr: '%s' ", mainServer.Addr)
-		if err := mainServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Errorf("can't serve on addr: '%s', error: %v", mainServer.Addr, err)
-		}
-	}()
+	mainServer.TLSConfig = tlsConfig
+	mainNetwork := "tcp"
+	if config.ServerSocket != "" {
+		mainServer.Addr, mainNetwork = config.ServerSocket, "unix"
+	}
+	start("server", mainServer, mainNetwork)
 
 	healthRouter := chi.NewRouter()
-	healthRouter.Get("/metrics", promhttp.Handler().ServeHTTP)
 	healthRouter.Get("/healthz", HealthCheckHandler)
-	healthRouter.Get("/readyz", ReadinessHandler)
+	healthRouter.Get("/readyz", ReadinessHandler(p))
+	if config.DriftEndpoint {
+		healthRouter.Get("/drift", DriftHandler(p))
+	}
+
+	healthServer := createHTTPServer(fmt.Sprintf("%s:%d", config.HealthHost, config.HealthPort), healthRouter, config.ServerReadTimeout, config.ServerWriteTimeout)
+	healthServer.TLSConfig = healthTLS
+	servers := []*http.Server{mainServer, healthServer}
+
+	if config.MetricsPort == 0 {
+		healthRouter.Get("/metrics", promhttp.Handler().ServeHTTP)
+	} else {
+		metricsRouter := chi.NewRouter()
+		metricsRouter.Get("/metrics", promhttp.Handler().ServeHTTP)
 
-	healthServer := createHTTPServer("0.0.0.0:8080", healthRouter, config.ServerReadTimeout, config.ServerWriteTimeout)
+		metricsServer := createHTTPServer(fmt.Sprintf("%s:%d", config.MetricsHost, config.MetricsPort), metricsRouter, config.ServerReadTimeout, config.ServerWriteTimeout)
+		metricsServer.TLSConfig = healthTLS
+		start("metrics server", metricsServer, "tcp")
+		servers = append(servers, metricsServer)
+	}
+	start("health server", healthServer, "tcp")
+
+	return servers
+}
+
+// start serves server in the background on addr of the given network, "tcp" or "unix"
+func start(name string, server *http.Server, network string) {
 	go func() {
-		log.Infof("starting health server on addr: '%s' ", healthServer.Addr)
-		if err := healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Errorf("can't serve health on addr: '%s', error: %v", healthServer.Addr, err)
+		log.Infof("starting %s on %s addr: '%s' ", name, network, server.Addr)
+		if err := serve(server, network); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("can't serve %s on addr: '%s', error: %v", name, server.Addr, err)
 		}
 	}()
+}
+
+// serve serves HTTPS if the server has a TLS configuration, plain HTTP otherwise.
+// A leftover unix socket from a previous run is removed before listening on it.
+func serve(server *http.Server, network string) error {
+	if network == "unix" {
+		if err := os.Remove(server.Addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen(network, server.Addr)
+	if err != nil {
+		return err
+	}
 
-	return mainServer, healthServer
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
 }
 
 func createHTTPServer(addr string, hand http.Handler, readTimeout, writeTimeout time.Duration) *http.Server {
@@ -71,21 +197,47 @@ func createHTTPServer(addr string, hand http.Handler, readTimeout, writeTimeout
 	}
 }
 
-// ShutdownGracefully gracefully shutdown the http server
-func ShutdownGracefully(mainServer *http.Server, healthServer *http.Server) {
+// ShutdownGracefully gracefully shutdown the http servers.
+// SIGHUP calls reload instead of shutting down, if reload is set. Reloads run in the background,
+// one at a time, so they never hold up a shutdown, which cancels the context of a reload in progress
+// and waits for it to return once the servers are shut down.
+func ShutdownGracefully(servers []*http.Server, reload func(ctx context.Context) error) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	sig := <-sigCh
+
+	reloadCtx, cancelReload := context.WithCancel(context.Background())
+	var reloading sync.WaitGroup
+	var busy atomic.Bool
+
+	var sig os.Signal
+	for sig = range sigCh {
+		if sig != syscall.SIGHUP || reload == nil {
+			break
+		}
+		if !busy.CompareAndSwap(false, true) {
+			log.Warn("ignoring signal SIGHUP, the configuration is still being reloaded")
+			continue
+		}
+		log.Info("reloading configuration due to received signal: SIGHUP")
+		reloading.Add(1)
+		go func() {
+			defer reloading.Done()
+			defer busy.Store(false)
+			if err := reload(reloadCtx); err != nil {
+				log.Errorf("reloading configuration failed, keeping the current one: %v", err)
+			}
+		}()
+	}
 
 	log.Infof("shutting down servers due to received signal: %v", sig)
+	cancelReload()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := mainServer.Shutdown(ctx); err != nil {
-		log.Errorf("error shutting down main server: %v", err)
-	}
-
-	if err := healthServer.Shutdown(ctx); err != nil {
-		log.Errorf("error shutting down health server: %v", err)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("error shutting down server on addr '%s': %v", server.Addr, err)
+		}
 	}
+	reloading.Wait()
 }
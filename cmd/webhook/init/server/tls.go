@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
+	log "github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes at most
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves a certificate from disk and picks up changes to it,
+// e.g. when cert-manager renews a mounted secret, without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// newCertReloader loads the certificate, failing if it can't be loaded initially
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files changed.
+// If reloading fails the previous certificate is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		log.Errorf("tls: checking certificate %s for changes failed, keeping the current one: %v", r.certFile, err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	if err := r.load(modTime); err != nil {
+		log.Errorf("tls: reloading certificate %s failed, keeping the current one: %v", r.certFile, err)
+		return r.cert, nil
+	}
+	log.Infof("tls: reloaded certificate %s", r.certFile)
+	return r.cert, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// serverTLSConfig returns a TLS configuration serving the given certificate with the configured
+// minimum version and cipher suites, or nil if neither file is set
+func serverTLSConfig(config configuration.Config, certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are required")
+	}
+
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown minimum tls version '%s', must be one of 1.0, 1.1, 1.2 or 1.3", config.TLSMinVersion)
+	}
+
+	cipherSuites, err := cipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}, nil
+}
+
+// cipherSuites resolves cipher suite names as listed by Go's crypto/tls, e.g.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Insecure suites are refused.
+// An empty list keeps Go's defaults. TLS 1.3 suites aren't configurable.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// mainTLSConfig returns the TLS configuration of the main server, or nil if it serves plain HTTP.
+// Clients have to present a certificate signed by SERVER_TLS_CLIENT_CA_FILE if it is set.
+func mainTLSConfig(config configuration.Config) (*tls.Config, error) {
+	tlsConfig, err := serverTLSConfig(config, config.ServerTLSCertFile, config.ServerTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+
+	if config.ServerTLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("client certificate authentication requires SERVER_TLS_CERT_FILE and SERVER_TLS_KEY_FILE to be set")
+	}
+
+	pem, err := os.ReadFile(config.ServerTLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in client CA file '%s'", config.ServerTLSClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return tlsConfig, nil
+}
+
+// healthTLSConfig returns the TLS configuration of the health server, or nil if it serves plain HTTP
+func healthTLSConfig(config configuration.Config) (*tls.Config, error) {
+	tlsConfig, err := serverTLSConfig(config, config.HealthTLSCertFile, config.HealthTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("health server: %w", err)
+	}
+	return tlsConfig, nil
+}
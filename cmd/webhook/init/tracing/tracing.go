@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const serviceName = "external-dns-opnsense-webhook"
+
+// Init sets up tracing from the standard OTEL_* environmental variables.
+// Spans are only exported if OTEL_TRACES_EXPORTER is set to otlp, the OTLP exporter
+// itself is configured through OTEL_EXPORTER_OTLP_* as usual. W3C trace context
+// is propagated either way. The returned function flushes and stops tracing.
+func Init(version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER"))
+	switch exporter {
+	case "", "none":
+		log.Debug("tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter '%s', must be one of 'otlp' or 'none'", exporter)
+	}
+
+	ctx := context.Background()
+	otlpExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating otlp exporter failed: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating tracing resource failed: %w", err)
+	}
+
+	provider := NewTracerProvider(otlpExporter, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	log.Info("tracing is enabled, exporting spans with otlp")
+
+	return provider.Shutdown, nil
+}
+
+// NewTracerProvider creates a tracer provider sending spans to exporter in batches.
+// Tests can pass the in-memory exporter of go.opentelemetry.io/otel/sdk/trace/tracetest
+// and install the provider with otel.SetTracerProvider.
+func NewTracerProvider(exporter sdktrace.SpanExporter, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{sdktrace.WithBatcher(exporter)}, opts...)...)
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"time"
 
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/backup"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/configuration"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/dnsprovider"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/logging"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/server"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/cmd/webhook/init/tracing"
 	"github.com/crutonjohn/external-dns-opnsense-webhook/pkg/webhook"
 	log "github.com/sirupsen/logrus"
 )
@@ -17,22 +23,128 @@ version: %s (%s)
 
 `
 
+const configFlagUsage = "path to a YAML or JSON configuration file, environmental variables override its settings"
+
 var (
 	Version = "local"
 	Gitsha  = "?"
 )
 
+// options are the flags shared by every command
+type options struct {
+	configFile string
+}
+
+// flagSet creates the flags of a command, including the shared ones
+func (o *options) flagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&o.configFile, "config", o.configFile, configFlagUsage)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s\n\n", os.Args[0], usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+type command struct {
+	name        string
+	description string
+	run         func(o *options, args []string) error
+}
+
+var commands = []command{
+	{name: "serve", description: "serve the webhook for external-dns (default)", run: serve},
+	{name: "list", description: "print the records the webhook manages", run: list},
+	{name: "apply", description: "apply a plan of changes read from a JSON file", run: apply},
+	{name: "backup", description: "write the records the webhook manages to a JSON file", run: backupRecords},
+	{name: "restore", description: "recreate records missing from or changed in OPNsense since a backup", run: restore},
+	{name: "adopt", description: "mark unmanaged records as owned by the webhook", run: adopt},
+	{name: "check", description: "check the credentials and privileges on every OPNsense host", run: check},
+	{name: "validate-config", description: "validate the configuration without contacting OPNsense", run: validateConfig},
+}
+
 func main() {
+	o := &options{}
+	global := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	global.StringVar(&o.configFile, "config", "", configFlagUsage)
+	global.Usage = usage
+	global.Parse(os.Args[1:])
+
+	name, args := "serve", global.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+
+		logging.Init()
+		if c.name != "serve" && os.Getenv("LOG_LEVEL") == "" {
+			// Keep the output of the other commands readable
+			log.SetLevel(log.WarnLevel)
+		}
+
+		if err := c.run(o, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [--config file] [command] [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(out, "\nrun '%s <command> --help' for the flags of a command\n", os.Args[0])
+}
+
+// serve runs the webhook until it receives a shutdown signal
+func serve(o *options, args []string) error {
+	o.flagSet("serve", "serve [flags]").Parse(args)
+
 	fmt.Printf(banner, Version, Gitsha)
 
-	logging.Init()
+	shutdownTracing, err := tracing.Init(Version)
+	if err != nil {
+		log.Fatalf("failed to initialize tracing: %v", err)
+	}
 
-	config := configuration.Init()
-	provider, err := dnsprovider.Init(config)
+	config := configuration.Init(o.configFile)
+	settings, err := dnsprovider.Load(config)
 	if err != nil {
 		log.Fatalf("failed to initialize provider: %v", err)
 	}
+	provider, err := dnsprovider.New(settings)
+	if err != nil {
+		log.Fatalf("failed to initialize provider: %v", err)
+	}
+
+	hook := webhook.New(provider)
+	servers := server.Init(config, hook)
 
-	main, health := server.Init(config, webhook.New(provider))
-	server.ShutdownGracefully(main, health)
+	ctx, stopBackups := context.WithCancel(context.Background())
+	backup.Start(ctx, config, hook)
+
+	server.ShutdownGracefully(servers, dnsprovider.NewReloader(hook, config, settings).Reload)
+	stopBackups()
+	// Delivers the notifications still queued and flushes the audit log
+	if err := dnsprovider.Close(hook.Provider()); err != nil {
+		log.Errorf("error closing the provider: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Errorf("error shutting down tracing: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,303 @@
+// Package notify posts a summary of every applied batch of changes to outbound webhooks,
+// e.g. a Slack or Matrix channel or any HTTP endpoint.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// SignatureHeader holds the HMAC-SHA256 of the body as sha256=<hex>, if a secret is configured
+	SignatureHeader = "X-Webhook-Signature"
+	// DefaultTemplate posts the summary as JSON
+	DefaultTemplate = "{{ json . }}"
+	// initialRetryBackoff is the delay before the first retry, it doubles with every retry
+	initialRetryBackoff = time.Second
+)
+
+var notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "opnsense_webhook",
+	Name:      "notifications_total",
+	Help:      "Change notifications by result (success or failure), after retries.",
+}, []string{"result"})
+
+// Config holds the notification settings.
+type Config struct {
+	URLs         []string      `env:"NOTIFY_URLS" envDefault:"" yaml:"urls"`
+	Template     string        `env:"NOTIFY_TEMPLATE" yaml:"template"`
+	TemplateFile string        `env:"NOTIFY_TEMPLATE_FILE" yaml:"templateFile"`
+	ContentType  string        `env:"NOTIFY_CONTENT_TYPE" envDefault:"application/json" yaml:"contentType"`
+	Secret       string        `env:"NOTIFY_SECRET" yaml:"secret"`
+	SecretFile   string        `env:"NOTIFY_SECRET_FILE" yaml:"secretFile"`
+	Retries      int           `env:"NOTIFY_RETRIES" envDefault:"3" yaml:"retries"`
+	Timeout      time.Duration `env:"NOTIFY_TIMEOUT" envDefault:"10s" yaml:"timeout"`
+}
+
+// Validate reports settings that can't work. Template and secret files have to be read into the config already.
+func (c *Config) Validate() error {
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("notify url '%s': %w", u, err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("notify url '%s' must be an http or https url", u)
+		}
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("notify retries %d must not be negative", c.Retries)
+	}
+	if _, err := parseTemplate(c.Template); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Record is a created or deleted record of a batch.
+type Record struct {
+	Target  string   `json:"target"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Targets []string `json:"targets"`
+}
+
+// Update is an updated record of a batch.
+type Update struct {
+	Target     string   `json:"target"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	OldTargets []string `json:"oldTargets"`
+	NewTargets []string `json:"newTargets"`
+}
+
+// Summary describes an applied batch of changes, it is the data the template is executed with.
+type Summary struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID,omitempty"`
+	Creates   []Record  `json:"creates"`
+	Updates   []Update  `json:"updates"`
+	Deletes   []Record  `json:"deletes"`
+	// Text is a human readable description of the batch, e.g. for chat messages
+	Text string `json:"text"`
+}
+
+// Empty reports whether the batch changed nothing.
+func (s *Summary) Empty() bool {
+	return len(s.Creates) == 0 && len(s.Updates) == 0 && len(s.Deletes) == 0
+}
+
+// text renders the human readable description of the batch.
+func (s *Summary) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "external-dns applied %d creates, %d updates and %d deletes", len(s.Creates), len(s.Updates), len(s.Deletes))
+	for _, r := range s.Creates {
+		fmt.Fprintf(&b, "\ncreated %s %s -> %s", r.Type, r.Name, strings.Join(r.Targets, ","))
+	}
+	for _, u := range s.Updates {
+		fmt.Fprintf(&b, "\nupdated %s %s: %s -> %s", u.Type, u.Name, strings.Join(u.OldTargets, ","), strings.Join(u.NewTargets, ","))
+	}
+	for _, r := range s.Deletes {
+		fmt.Fprintf(&b, "\ndeleted %s %s -> %s", r.Type, r.Name, strings.Join(r.Targets, ","))
+	}
+	return b.String()
+}
+
+// Notifier posts summaries to the configured URLs. A nil Notifier does nothing.
+type Notifier struct {
+	urls        []string
+	template    *template.Template
+	contentType string
+	secret      []byte
+	retries     int
+	// backoff is the delay before the first retry, it doubles with every retry
+	backoff time.Duration
+	client  *http.Client
+	wg      sync.WaitGroup
+	// stop is closed by Close to cut the backoff of deliveries in flight short
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a Notifier, or returns nil if no URL is configured.
+func New(config *Config) (*Notifier, error) {
+	if len(config.URLs) == 0 {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	tmpl, err := parseTemplate(config.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		urls:        config.URLs,
+		template:    tmpl,
+		contentType: config.ContentType,
+		secret:      []byte(config.Secret),
+		retries:     config.Retries,
+		backoff:     initialRetryBackoff,
+		client:      &http.Client{Timeout: config.Timeout},
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("notify").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"join": strings.Join,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("notify template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Notify posts summary to every URL in the background, retrying failed deliveries.
+// It never blocks the batch the summary describes.
+func (n *Notifier) Notify(ctx context.Context, summary Summary) {
+	if n == nil || summary.Empty() {
+		return
+	}
+
+	summary.Time = time.Now().UTC()
+	summary.RequestID = requestid.FromContext(ctx)
+	summary.Text = summary.text()
+	// Templates and receivers see empty lists rather than null
+	if summary.Creates == nil {
+		summary.Creates = []Record{}
+	}
+	if summary.Updates == nil {
+		summary.Updates = []Update{}
+	}
+	if summary.Deletes == nil {
+		summary.Deletes = []Record{}
+	}
+
+	var body bytes.Buffer
+	if err := n.template.Execute(&body, summary); err != nil {
+		requestid.Log(ctx).Errorf("notify: rendering the template failed: %v", err)
+		notifications.WithLabelValues("failure").Inc()
+		return
+	}
+
+	// The notification outlives the request that applied the batch
+	ctx = context.WithoutCancel(ctx)
+	for _, u := range n.urls {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.deliver(ctx, u, body.Bytes())
+		}()
+	}
+}
+
+// Wait blocks until the notifications in flight were delivered or gave up.
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// Close stops waiting between retries, e.g. on shutdown: a delivery backing off makes
+// its last attempt right away. Call Wait afterwards for the deliveries to finish.
+func (n *Notifier) Close() {
+	if n != nil {
+		n.stopOnce.Do(func() { close(n.stop) })
+	}
+}
+
+// deliver posts body to u, retrying with exponential backoff on network errors, 429 and 5xx responses.
+// Once the notifier is closed, a delivery still backing off makes its last attempt right away.
+func (n *Notifier) deliver(ctx context.Context, u string, body []byte) {
+	backoff := n.backoff
+	stopped := false
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(ctx, u, body)
+		if err == nil {
+			notifications.WithLabelValues("success").Inc()
+			requestid.Log(ctx).Debugf("notify: delivered to %s", RedactURL(u))
+			return
+		}
+		if !retry || attempt >= n.retries || stopped {
+			notifications.WithLabelValues("failure").Inc()
+			requestid.Log(ctx).Errorf("notify: delivering to %s failed after %d attempts: %v", RedactURL(u), attempt+1, err)
+			return
+		}
+
+		requestid.Log(ctx).Warnf("notify: delivering to %s failed, retrying in %s: %v", RedactURL(u), backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-n.stop:
+			timer.Stop()
+			stopped = true
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single request, returning whether a failure is worth retrying.
+func (n *Notifier) post(ctx context.Context, u string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", n.contentType)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// RedactURL drops the path and query of a URL for logging, chat webhooks carry their token in it
+func RedactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "notify url"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
@@ -0,0 +1,266 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+)
+
+// receiver records the notifications posted to it, answering with the given status codes in turn and 200 afterwards.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func newTestNotifier(t *testing.T, config Config) *Notifier {
+	t.Helper()
+	if config.ContentType == "" {
+		config.ContentType = "application/json"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	n, err := New(&config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	n.backoff = time.Millisecond
+	return n
+}
+
+var testSummary = Summary{
+	Creates: []Record{{Target: "default", Name: "nas.example.com", Type: "A", Targets: []string{"192.168.1.10"}}},
+	Updates: []Update{{Target: "default", Name: "app.example.com", Type: "A", OldTargets: []string{"192.168.1.20"}, NewTargets: []string{"192.168.1.21"}}},
+}
+
+func TestNotifyPostsTheSummarySigned(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{URLs: []string{server.URL + "/hook"}, Secret: "s3cret"})
+	n.Notify(requestid.NewContext(context.Background(), "req-1"), testSummary)
+	n.Wait()
+
+	if len(r.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(r.requests))
+	}
+	req, body := r.requests[0], r.bodies[0]
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := req.Header.Get(SignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+	if got := req.Header.Get(requestid.Header); got != "req-1" {
+		t.Errorf("%s = %q, want req-1", requestid.Header, got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var summary Summary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		t.Fatalf("the default template didn't render JSON: %v\n%s", err, body)
+	}
+	if summary.RequestID != "req-1" || len(summary.Creates) != 1 || len(summary.Updates) != 1 || summary.Deletes == nil {
+		t.Errorf("unexpected summary: %s", body)
+	}
+}
+
+func TestNotifyWithoutSecretIsUnsigned(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{URLs: []string{server.URL}})
+	n.Notify(context.Background(), testSummary)
+	n.Wait()
+
+	if len(r.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(r.requests))
+	}
+	if got := r.requests[0].Header.Get(SignatureHeader); got != "" {
+		t.Errorf("%s = %q, want none", SignatureHeader, got)
+	}
+}
+
+func TestNotifyRendersTheTemplate(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{
+		URLs:     []string{server.URL},
+		Template: `{"text": {{ json .Text }}, "first": "{{ (index .Creates 0).Name }} -> {{ join (index .Creates 0).Targets "," }}"}`,
+	})
+	n.Notify(context.Background(), testSummary)
+	n.Wait()
+
+	var body struct {
+		Text  string `json:"text"`
+		First string `json:"first"`
+	}
+	if err := json.Unmarshal(r.bodies[0], &body); err != nil {
+		t.Fatalf("the template didn't render JSON: %v\n%s", err, r.bodies[0])
+	}
+	wantText := "external-dns applied 1 creates, 1 updates and 0 deletes\n" +
+		"created A nas.example.com -> 192.168.1.10\n" +
+		"updated A app.example.com: 192.168.1.20 -> 192.168.1.21"
+	if body.Text != wantText {
+		t.Errorf("text = %q, want %q", body.Text, wantText)
+	}
+	if body.First != "nas.example.com -> 192.168.1.10" {
+		t.Errorf("first = %q", body.First)
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		retries  int
+		want     int
+	}{
+		{name: "429 and 5xx are retried", statuses: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable}, retries: 3, want: 4},
+		{name: "retries are limited", statuses: []int{500, 500, 500, 500, 500}, retries: 2, want: 3},
+		{name: "4xx is not retried", statuses: []int{http.StatusBadRequest}, retries: 3, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &receiver{statuses: tc.statuses}
+			server := httptest.NewServer(r)
+			defer server.Close()
+
+			n := newTestNotifier(t, Config{URLs: []string{server.URL}, Retries: tc.retries})
+			n.Notify(context.Background(), testSummary)
+			n.Wait()
+
+			if len(r.requests) != tc.want {
+				t.Errorf("got %d requests, want %d", len(r.requests), tc.want)
+			}
+			for i, body := range r.bodies[1:] {
+				if string(body) != string(r.bodies[0]) {
+					t.Errorf("retry %d posted a different body", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyBacksOffExponentially(t *testing.T) {
+	r := &receiver{statuses: []int{503, 503, 503}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{URLs: []string{server.URL}, Retries: 3})
+	n.backoff = 20 * time.Millisecond
+	start := time.Now()
+	n.Notify(context.Background(), testSummary)
+	n.Wait()
+
+	// 20ms + 40ms + 80ms
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("the retries took %s, want at least 140ms", elapsed)
+	}
+	if len(r.requests) != 4 {
+		t.Errorf("got %d requests, want 4", len(r.requests))
+	}
+}
+
+func TestCloseCutsTheBackoffShort(t *testing.T) {
+	r := &receiver{statuses: []int{503, 503, 503}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{URLs: []string{server.URL}, Retries: 3})
+	n.backoff = time.Hour
+	n.Notify(context.Background(), testSummary)
+
+	// Wait for the first attempt, the delivery is backing off afterwards
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		attempts := len(r.requests)
+		r.mu.Unlock()
+		if attempts > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the notification wasn't posted")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		n.Close()
+		n.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked on the backoff after Close")
+	}
+	if len(r.requests) != 2 {
+		t.Errorf("got %d requests, want the first attempt and a last one on Close", len(r.requests))
+	}
+}
+
+func TestNotifySkipsEmptyBatches(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := newTestNotifier(t, Config{URLs: []string{server.URL}})
+	n.Notify(context.Background(), Summary{})
+	n.Wait()
+
+	if len(r.requests) != 0 {
+		t.Errorf("got %d requests for an empty batch, want none", len(r.requests))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, config := range []Config{
+		{URLs: []string{"ftp://example.com"}},
+		{URLs: []string{"https://"}},
+		{Template: "{{ .Text"},
+		{Retries: -1},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded, want an error", config)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	if got := RedactURL("https://hooks.slack.com/services/T000/B000/TOKEN?x=1"); got != "https://hooks.slack.com" {
+		t.Errorf("RedactURL = %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+package opnsense
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ownedBy reports whether record carries the ownership marker, as a word of its description.
+// Every record is owned if no marker is configured.
+func ownedBy(record Record, marker string) bool {
+	return describedBy(record, marker)
+}
+
+// describedBy reports whether every word of description is a word of the description of record.
+func describedBy(record Record, description string) bool {
+	return containsWords(record.Description, description)
+}
+
+// containsWords reports whether every word of words is a word of text.
+func containsWords(text, words string) bool {
+	fields := strings.Fields(text)
+	for _, word := range strings.Fields(words) {
+		if !slices.Contains(fields, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeDescription appends the words of wanted missing from description, keeping what was there.
+func mergeDescription(description, wanted string) string {
+	for _, word := range strings.Fields(wanted) {
+		if containsWords(description, word) {
+			continue
+		}
+		if description == "" {
+			description = word
+			continue
+		}
+		description += " " + word
+	}
+	return description
+}
+
+// AdoptSelector selects the unmanaged records to adopt. A record has to match every criterion that is set.
+// An empty selector selects every unmanaged record the configured domain filters match.
+type AdoptSelector struct {
+	// Domains are matched like DOMAIN_FILTER
+	Domains []string
+	// Regex is matched against the FQDN
+	Regex *regexp.Regexp
+	// Description is matched against the description
+	Description *regexp.Regexp
+}
+
+func (s AdoptSelector) empty() bool {
+	return len(s.Domains) == 0 && s.Regex == nil && s.Description == nil
+}
+
+func (s AdoptSelector) matches(record Record) bool {
+	name := record.Name
+	if len(s.Domains) > 0 && !endpoint.NewDomainFilter(s.Domains).Match(name) {
+		return false
+	}
+	if s.Regex != nil && !s.Regex.MatchString(name) {
+		return false
+	}
+	if s.Description != nil && !s.Description.MatchString(record.Description) {
+		return false
+	}
+	return true
+}
+
+// AdoptChange is a record Adopt marks, or would mark, as owned.
+type AdoptChange struct {
+	Target string
+	Record Record
+}
+
+func (c AdoptChange) String() string {
+	return fmt.Sprintf("adopt %s %s on target '%s': %s", c.Record.Type, c.Record.Name, c.Target, c.Record.Target)
+}
+
+// Adopt stamps the configured ownership marker on the records in the managed domains that match selector
+// and don't carry it yet, so the webhook manages them from then on.
+// With dryRun set nothing is changed, the returned changes describe what would be adopted.
+func (p *Provider) Adopt(ctx context.Context, selector AdoptSelector, dryRun bool) ([]AdoptChange, error) {
+	p.changing.RLock()
+	defer p.changing.RUnlock()
+
+	if p.marker == "" {
+		return nil, fmt.Errorf("no ownership marker is configured, every record in the managed domains is managed already")
+	}
+	if selector.empty() {
+		// Without any domain filter an empty selector would adopt every record on the firewall
+		for _, t := range p.targets {
+			if !p.domainFilter.IsConfigured() && !t.domainFilter.IsConfigured() {
+				return nil, fmt.Errorf("no domain filter is configured for target '%s', select the records to adopt by domain, regex or description", t.name)
+			}
+		}
+	}
+	if err := p.connected(); err != nil {
+		return nil, unavailable(fmt.Errorf("adopt: %w", err))
+	}
+
+	var changes []AdoptChange
+	for _, t := range p.targets {
+		records, err := t.backend.List(ctx)
+		if err != nil {
+			return nil, unavailable(fmt.Errorf("adopt: target '%s': %w", t.name, err))
+		}
+
+		var adopt []AdoptChange
+		for _, record := range records {
+			if !p.domainFilter.Match(record.Name) || !t.domainFilter.Match(record.Name) || ownedBy(record, p.marker) || p.protection.record(record) || !selector.matches(record) {
+				continue
+			}
+			adopt = append(adopt, AdoptChange{Target: t.name, Record: record})
+		}
+		slices.SortFunc(adopt, func(a, b AdoptChange) int {
+			return cmp.Or(
+				cmp.Compare(a.Record.Name, b.Record.Name),
+				cmp.Compare(a.Record.Type, b.Record.Type),
+				cmp.Compare(a.Record.Target, b.Record.Target),
+			)
+		})
+		changes = append(changes, adopt...)
+
+		if dryRun || len(adopt) == 0 {
+			continue
+		}
+
+		requestid.Log(ctx).Infof("adopt: adopting %d records on target '%s'", len(adopt), t.name)
+		for _, change := range adopt {
+			record := change.Record
+			record.Description = p.marker
+			err := t.backend.Update(ctx, change.Record, record)
+			if errors.Is(err, errRecordNotFound) {
+				requestid.Log(ctx).Warnf("adopt: %s was removed in the meantime, skipping it", change)
+				continue
+			}
+			if err != nil {
+				p.cache.invalidate()
+				return nil, unavailable(fmt.Errorf("adopt: target '%s': %s: %w", t.name, change, err))
+			}
+		}
+		if err := t.backend.Apply(ctx); err != nil {
+			p.cache.invalidate()
+			return nil, unavailable(fmt.Errorf("adopt: target '%s': %w", t.name, err))
+		}
+		// Adopted records are expected and managed from now on
+		t.drift.forget()
+		t.managedCount.Store(-1)
+		p.cache.invalidate()
+	}
+	return changes, nil
+}
@@ -0,0 +1,113 @@
+package opnsense
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func adoptedNames(changes []AdoptChange) []string {
+	var names []string
+	for _, c := range changes {
+		names = append(names, c.Record.Name)
+	}
+	return names
+}
+
+func TestAdoptMarksOnlyMatchingUnownedRecords(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", "external-dns"),
+		memoryRecord("app.example.com", "192.168.1.20", "set up by hand"),
+		memoryRecord("www.example.com", "192.168.1.30", ""),
+		memoryRecord("router.example.com", "192.168.1.1", ""),
+		memoryRecord("www.example.org", "192.168.1.40", ""),
+	)
+	p := newTestProvider(t, []string{"example.com"}, ProviderConfig{
+		OwnershipMarker:  "external-dns",
+		ProtectedRecords: []string{"router.example.com"},
+	}, target)
+	ctx := context.Background()
+
+	// The selector defaults to the configured domain filter
+	changes, err := p.Adopt(ctx, AdoptSelector{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := adoptedNames(changes), []string{"app.example.com", "www.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("dry run adopts %v, want %v", got, want)
+	}
+	if backend.Applied() != 0 {
+		t.Error("the dry run applied changes")
+	}
+
+	changes, err = p.Adopt(ctx, AdoptSelector{Regex: regexp.MustCompile(`^app\.`)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := adoptedNames(changes), []string{"app.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Adopt = %v, want %v", got, want)
+	}
+
+	want := map[string]string{
+		"nas.example.com":    "external-dns",
+		"app.example.com":    "set up by hand external-dns",
+		"www.example.com":    "",
+		"router.example.com": "",
+		"www.example.org":    "",
+	}
+	for _, r := range backend.Records() {
+		if r.Description != want[r.Name] {
+			t.Errorf("%s is described as %q, want %q", r.Name, r.Description, want[r.Name])
+		}
+	}
+
+	endpoints, err := p.Records(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := endpointNames(endpoints), []string{"app.example.com", "nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v after adopting, want %v", got, want)
+	}
+}
+
+func TestAdoptIsIdempotent(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+		memoryRecord("app.example.com", "192.168.1.20", ""),
+	)
+	p := newTestProvider(t, []string{"example.com"}, ProviderConfig{OwnershipMarker: "external-dns"}, target)
+	ctx := context.Background()
+
+	changes, err := p.Adopt(ctx, AdoptSelector{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Adopt = %v, want both records", changes)
+	}
+	before, applied := backend.Records(), backend.Applied()
+
+	changes, err = p.Adopt(ctx, AdoptSelector{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 || backend.Applied() != applied {
+		t.Errorf("adopting again adopted %v, want nothing", changes)
+	}
+	if after := backend.Records(); !slices.Equal(after, before) {
+		t.Errorf("adopting again changed the records from %v to %v", before, after)
+	}
+}
+
+func TestAdoptRefusesAnEmptySelectorWithoutDomainFilter(t *testing.T) {
+	target, backend := memoryTarget(memoryRecord("nas.example.com", "192.168.1.10", ""))
+	p := newTestProvider(t, nil, ProviderConfig{OwnershipMarker: "external-dns"}, target)
+
+	if _, err := p.Adopt(context.Background(), AdoptSelector{}, false); err == nil {
+		t.Error("Adopt succeeded with an empty selector and no domain filter")
+	}
+	if r := backend.Records()[0]; r.Description != "" {
+		t.Errorf("the record was adopted: %+v", r)
+	}
+}
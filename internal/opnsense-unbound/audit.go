@@ -0,0 +1,226 @@
+package opnsense
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditActionAdd         = "add"
+	AuditActionSet         = "set"
+	AuditActionDelete      = "delete"
+	AuditActionReconfigure = "reconfigure"
+)
+
+// AuditTypeAlias is the type recorded for aliases of host overrides, e.g. added by a restore
+const AuditTypeAlias = "alias"
+
+// Outcomes recorded in the audit log
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditStdout is the AUDIT_LOG value writing the audit log to stdout
+const AuditStdout = "stdout"
+
+// AuditEvent is a single change sent to OPNsense, written to the audit log as a JSON line.
+type AuditEvent struct {
+	Time      time.Time  `json:"time"`
+	RequestID string     `json:"requestID,omitempty"`
+	Target    string     `json:"target"`
+	Host      string     `json:"host"`
+	Action    string     `json:"action"`
+	Name      string     `json:"name,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	UUID      string     `json:"uuid,omitempty"`
+	Before    *DNSRecord `json:"before,omitempty"`
+	After     *DNSRecord `json:"after,omitempty"`
+	Outcome   string     `json:"outcome"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// auditLog writes AuditEvents to stdout or a rotating file. A nil auditLog discards them.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// path and refs are guarded by auditLogs.mu
+	path string
+	refs int
+}
+
+// auditLogs holds the open audit log files by path. Providers share them, so while a reloaded
+// provider takes over, a single rotatingFile keeps track of size and rotation.
+var auditLogs = struct {
+	mu   sync.Mutex
+	open map[string]*auditLog
+}{open: make(map[string]*auditLog)}
+
+// newAuditLog opens the audit log configured in config, or returns nil if none is.
+// An audit log file that is open already is shared, taking over the rotation settings of config.
+// Every audit log has to be closed once it is no longer used.
+func newAuditLog(config *ProviderConfig) (*auditLog, error) {
+	switch config.AuditLog {
+	case "":
+		return nil, nil
+	case AuditStdout:
+		return &auditLog{w: os.Stdout}, nil
+	}
+
+	auditLogs.mu.Lock()
+	defer auditLogs.mu.Unlock()
+
+	maxSize := int64(config.AuditLogMaxSize) * 1024 * 1024
+	if a, ok := auditLogs.open[config.AuditLog]; ok {
+		a.mu.Lock()
+		f := a.w.(*rotatingFile)
+		f.maxSize, f.maxBackups = maxSize, config.AuditLogMaxBackups
+		a.mu.Unlock()
+		a.refs++
+		return a, nil
+	}
+
+	f, err := openRotatingFile(config.AuditLog, maxSize, config.AuditLogMaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	a := &auditLog{w: f, path: config.AuditLog, refs: 1}
+	auditLogs.open[config.AuditLog] = a
+	return a, nil
+}
+
+// record completes event with the time, the request ID carried by ctx and the outcome of err, and writes it.
+// Failing to write the audit log is logged but never fails the change itself.
+func (a *auditLog) record(ctx context.Context, event AuditEvent, err error) {
+	if a == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.RequestID = requestid.FromContext(ctx)
+	event.Outcome = AuditOutcomeSuccess
+	if err != nil {
+		event.Outcome = AuditOutcomeFailure
+		event.Error = err.Error()
+	}
+
+	line, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		log.Errorf("audit: encoding event: %v", jsonErr)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Errorf("audit: writing event: %v", err)
+	}
+}
+
+// auditEvent records a change sent to the host of this client in the audit log.
+func (c *httpClient) auditEvent(ctx context.Context, event AuditEvent, err error) {
+	event.Target, event.Host = c.target, c.host
+	c.audit.record(ctx, event, err)
+}
+
+// Close releases the audit log, closing its file once no provider uses it anymore.
+func (a *auditLog) Close() error {
+	if a == nil || a.path == "" {
+		return nil
+	}
+
+	auditLogs.mu.Lock()
+	defer auditLogs.mu.Unlock()
+	a.refs--
+	if a.refs > 0 {
+		return nil
+	}
+	delete(auditLogs.open, a.path)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.(*rotatingFile).Close()
+}
+
+// rotatingFile is a file that is renamed to path.1, path.2, ... once it grows beyond maxSize,
+// keeping up to maxBackups old files. A maxSize of zero never rotates.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotating %s: %w", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a new file.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
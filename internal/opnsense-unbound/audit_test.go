@@ -0,0 +1,57 @@
+package opnsense
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestAuditLogIsSharedAcrossProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := &ProviderConfig{AuditLog: path, AuditLogMaxSize: 100, AuditLogMaxBackups: 5}
+
+	previous, err := newAuditLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := newAuditLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != reloaded {
+		t.Fatal("the audit log file was opened twice")
+	}
+
+	// The previous provider is closed while the reloaded one keeps writing
+	if err := previous.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded.record(context.Background(), AuditEvent{Action: AuditActionReconfigure}, nil)
+	if got := countLines(t, path); got != 1 {
+		t.Errorf("got %d audit lines, want 1", got)
+	}
+
+	if err := reloaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := auditLogs.open[path]; ok {
+		t.Error("the audit log is still open after every provider closed it")
+	}
+}
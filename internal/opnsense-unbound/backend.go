@@ -0,0 +1,141 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// errRecordNotFound is returned by Backend.Update if no record matches the one to replace
+var errRecordNotFound = errors.New("record not found")
+
+// Record is a DNS record as the provider sees it, whatever DNS service keeps it.
+type Record struct {
+	// ID identifies the record on a single host, e.g. the uuid of an Unbound host override
+	ID string `json:"id,omitempty"`
+	// Name is the fully qualified name of the record, without a trailing dot
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Target is the address or name the record points to
+	Target  string `json:"target"`
+	Enabled bool   `json:"enabled"`
+	// Description carries the ownership marker, besides whatever was written to it by hand
+	Description string `json:"description,omitempty"`
+}
+
+// key identifies a record by its name and type, e.g. to index records.
+func (r Record) key() string {
+	return r.Name + "/" + r.Type
+}
+
+// Backend is the DNS service on OPNsense a target keeps its records in, e.g. Unbound.
+// The provider filters, owns and batches the records, a backend only stores them:
+// Create, Update and Delete stage a change, which takes effect once Apply is called.
+type Backend interface {
+	// Login verifies the service can be reached with the configured credentials
+	Login(ctx context.Context) error
+	// Status checks the service is up, for readiness probes
+	Status(ctx context.Context) error
+	// List returns every record of the service, managed or not
+	List(ctx context.Context) ([]Record, error)
+	// Create adds record unless one with the same name and type exists already, which is returned instead
+	Create(ctx context.Context, record Record) (*Record, error)
+	// Update replaces the record with the name, type and target of old that carries every word
+	// of its description with record. The words of the description of record are added to the
+	// existing description, so what was written to it by hand is kept.
+	// It returns errRecordNotFound if no record matches old.
+	Update(ctx context.Context, old, record Record) error
+	// Delete removes the record with the name and type of record that carries
+	// every word of its description, e.g. the ownership marker
+	Delete(ctx context.Context, record Record) error
+	// Apply activates the staged changes
+	Apply(ctx context.Context) error
+	// Health returns the last error seen for every host of the service, keyed by host
+	Health() map[string]error
+	// Close releases the connections of the backend
+	Close()
+}
+
+// Alias is an additional name of a record, e.g. an alias of an Unbound host override.
+type Alias struct {
+	// Name is the fully qualified name of the alias, without a trailing dot
+	Name string `json:"name"`
+	// Record and RecordType identify the record the alias belongs to, ids differ between hosts and restores
+	Record      string `json:"record"`
+	RecordType  string `json:"recordType"`
+	Enabled     bool   `json:"enabled"`
+	Description string `json:"description,omitempty"`
+}
+
+// key identifies an alias by its name and the record it belongs to.
+func (a Alias) key() string {
+	return a.Name + "/" + a.Record + "/" + a.RecordType
+}
+
+// recordKey is the key of the record the alias belongs to, see Record.key.
+func (a Alias) recordKey() string {
+	return a.Record + "/" + a.RecordType
+}
+
+// aliaser is implemented by backends keeping aliases of records. The provider doesn't manage
+// aliases, they are only backed up and restored along with the records they belong to.
+type aliaser interface {
+	// listAliases returns every alias of the service
+	listAliases(ctx context.Context) ([]Alias, error)
+	// createAlias adds alias to the record it belongs to, unless it exists already.
+	// Like Create it is staged until Apply is called.
+	createAlias(ctx context.Context, alias Alias) error
+}
+
+// reconciler is implemented by backends spreading records over several hosts,
+// which may have to be brought back in line after a batch. Only the records managed reports true for are touched.
+type reconciler interface {
+	reconcile(ctx context.Context, managed func(Record) bool) error
+}
+
+// checker is implemented by backends that check their hosts in more detail than Login and List.
+type checker interface {
+	check(ctx context.Context, target string) []CheckResult
+}
+
+// endpointToRecord is the record the provider asks a backend to create for ep, carrying the ownership marker.
+func endpointToRecord(ep *endpoint.Endpoint, marker string) Record {
+	record := Record{
+		Name:        ep.DNSName,
+		Type:        ep.RecordType,
+		Enabled:     true,
+		Description: marker,
+	}
+	if len(ep.Targets) > 0 {
+		record.Target = ep.Targets[0]
+	}
+	return record
+}
+
+// recordToEndpoint converts a record into an external-dns endpoint.
+func recordToEndpoint(record Record) *endpoint.Endpoint {
+	return &endpoint.Endpoint{
+		DNSName:    record.Name,
+		RecordType: record.Type,
+		Targets:    endpoint.NewTargets(record.Target),
+	}
+}
+
+// indexRecords keys the records keep reports true for by their name and type. A nil keep keeps every record.
+func indexRecords(records []Record, keep func(Record) bool) map[string]Record {
+	index := make(map[string]Record, len(records))
+	for _, r := range records {
+		if keep != nil && !keep(r) {
+			continue
+		}
+		index[r.key()] = r
+	}
+	return index
+}
+
+// matches reports whether r has the name, type and, if old has one, target of old
+// and carries every word of its description.
+func (r Record) matches(old Record) bool {
+	return r.Name == old.Name && r.Type == old.Type && (old.Target == "" || r.Target == old.Target) && describedBy(r, old.Description)
+}
@@ -0,0 +1,318 @@
+package opnsense
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// BackupVersion is the version of the backup format written by Backup.
+// Version 1 held the records as Unbound returns them, version 2 had no aliases, both are still read.
+const BackupVersion = 3
+
+const (
+	// RestoreCreate restores a record missing from OPNsense
+	RestoreCreate = "create"
+	// RestoreUpdate restores a record whose target was changed in OPNsense
+	RestoreUpdate = "update"
+	// RestoreCreateAlias restores an alias missing from OPNsense
+	RestoreCreateAlias = "create-alias"
+)
+
+// Backup holds the Host Overrides managed by the webhook and their aliases, per target.
+type Backup struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Targets   []TargetBackup `json:"targets"`
+}
+
+// TargetBackup holds the Host Overrides managed on a single target and their aliases.
+type TargetBackup struct {
+	Name    string   `json:"name"`
+	Records []Record `json:"records"`
+	Aliases []Alias  `json:"aliases,omitempty"`
+}
+
+// backupV1 is version 1 of the backup format.
+type backupV1 struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Targets   []struct {
+		Name    string      `json:"name"`
+		Records []DNSRecord `json:"records"`
+	} `json:"targets"`
+}
+
+// DecodeBackup reads a backup of any version up to BackupVersion, rejecting unknown fields.
+func DecodeBackup(r io.Reader) (*Backup, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(b, &version); err != nil {
+		return nil, err
+	}
+	if version.Version < 1 || version.Version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d, this webhook reads up to version %d", version.Version, BackupVersion)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if version.Version == 1 {
+		var v1 backupV1
+		if err := dec.Decode(&v1); err != nil {
+			return nil, err
+		}
+		backup := &Backup{Version: BackupVersion, CreatedAt: v1.CreatedAt}
+		for _, tb := range v1.Targets {
+			records := make([]Record, 0, len(tb.Records))
+			for _, r := range tb.Records {
+				records = append(records, r.record())
+			}
+			backup.Targets = append(backup.Targets, TargetBackup{Name: tb.Name, Records: records})
+		}
+		return backup, nil
+	}
+
+	var backup Backup
+	if err := dec.Decode(&backup); err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// RestoreChange is a change Restore makes, or would make, to bring a target back to a backup.
+type RestoreChange struct {
+	Target string
+	Action string
+	Record Record
+	// Current is the record found in OPNsense for updates
+	Current *Record
+	// Alias is the alias created by RestoreCreateAlias, Record is unset then
+	Alias *Alias
+}
+
+// name is the name of the record or alias the change restores.
+func (c RestoreChange) name() string {
+	if c.Alias != nil {
+		return c.Alias.Name
+	}
+	return c.Record.Name
+}
+
+func (c RestoreChange) String() string {
+	if c.Alias != nil {
+		return fmt.Sprintf("%s %s on target '%s': alias of %s %s", c.Action, c.Alias.Name, c.Target, c.Alias.RecordType, c.Alias.Record)
+	}
+	if c.Current != nil {
+		return fmt.Sprintf("%s %s %s on target '%s': %s -> %s", c.Action, c.Record.Type, c.Record.Name, c.Target, c.Current.Target, c.Record.Target)
+	}
+	return fmt.Sprintf("%s %s %s on target '%s': %s", c.Action, c.Record.Type, c.Record.Name, c.Target, c.Record.Target)
+}
+
+// Backup reads the Host Overrides managed by the webhook from every target, along with their aliases.
+func (p *Provider) Backup(ctx context.Context) (*Backup, error) {
+	if err := p.connected(); err != nil {
+		return nil, unavailable(fmt.Errorf("backup: %w", err))
+	}
+
+	backup := &Backup{Version: BackupVersion, CreatedAt: time.Now().UTC()}
+	for _, t := range p.targets {
+		records, err := t.backend.List(ctx)
+		if err != nil {
+			return nil, unavailable(fmt.Errorf("backup: target '%s': %w", t.name, err))
+		}
+
+		managed := p.managed(t, records)
+		if managed == nil {
+			managed = []Record{}
+		}
+		aliases, err := p.managedAliases(ctx, t, managed)
+		if err != nil {
+			return nil, unavailable(fmt.Errorf("backup: target '%s': %w", t.name, err))
+		}
+		backup.Targets = append(backup.Targets, TargetBackup{Name: t.name, Records: managed, Aliases: aliases})
+	}
+	return backup, nil
+}
+
+// managedAliases returns the aliases of the records of target t, if its backend keeps aliases.
+func (p *Provider) managedAliases(ctx context.Context, t *target, records []Record) ([]Alias, error) {
+	a, ok := t.backend.(aliaser)
+	if !ok {
+		return nil, nil
+	}
+	aliases, err := a.listAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	index := indexRecords(records, nil)
+	var managed []Alias
+	for _, alias := range aliases {
+		if _, ok := index[alias.recordKey()]; ok {
+			managed = append(managed, alias)
+		}
+	}
+	slices.SortFunc(managed, func(a, b Alias) int { return cmp.Compare(a.key(), b.key()) })
+	return managed, nil
+}
+
+// Restore compares a backup against the live Host Overrides and recreates the records that
+// are missing or point somewhere else, then the missing aliases of the records of the backup.
+// Records and aliases added since the backup are left alone.
+// With dryRun set nothing is changed, the returned changes describe what would be done.
+func (p *Provider) Restore(ctx context.Context, backup *Backup, dryRun bool) ([]RestoreChange, error) {
+	p.changing.RLock()
+	defer p.changing.RUnlock()
+
+	if backup.Version < 1 || backup.Version > BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d, this webhook reads up to version %d", backup.Version, BackupVersion)
+	}
+	if err := p.connected(); err != nil {
+		return nil, unavailable(fmt.Errorf("restore: %w", err))
+	}
+
+	targets := make(map[string]*target, len(p.targets))
+	for _, t := range p.targets {
+		targets[t.name] = t
+	}
+
+	var changes []RestoreChange
+	routed := make(map[*target]*plan.Changes)
+	aliases := make(map[*target][]Alias)
+	for _, tb := range backup.Targets {
+		t, ok := targets[tb.Name]
+		if !ok {
+			return nil, fmt.Errorf("the backup holds target '%s', which isn't configured", tb.Name)
+		}
+
+		records, err := t.backend.List(ctx)
+		if err != nil {
+			return nil, unavailable(fmt.Errorf("restore: target '%s': %w", t.name, err))
+		}
+		live := indexRecords(p.managed(t, records), nil)
+
+		wanted := indexRecords(p.managed(t, tb.Records), nil)
+		tc := &plan.Changes{}
+		for key, want := range wanted {
+			have, ok := live[key]
+			switch {
+			case !ok:
+				changes = append(changes, RestoreChange{Target: t.name, Action: RestoreCreate, Record: want})
+				tc.Create = append(tc.Create, recordToEndpoint(want))
+			case have.Target != want.Target:
+				changes = append(changes, RestoreChange{Target: t.name, Action: RestoreUpdate, Record: want, Current: &have})
+				tc.UpdateOld = append(tc.UpdateOld, recordToEndpoint(have))
+				tc.UpdateNew = append(tc.UpdateNew, recordToEndpoint(want))
+			}
+		}
+		if len(tc.Create) > 0 || len(tc.UpdateNew) > 0 {
+			routed[t] = tc
+		}
+
+		missing, err := p.missingAliases(ctx, t, tb.Aliases, wanted)
+		if err != nil {
+			return nil, err
+		}
+		for _, alias := range missing {
+			changes = append(changes, RestoreChange{Target: t.name, Action: RestoreCreateAlias, Alias: &alias})
+		}
+		if len(missing) > 0 {
+			aliases[t] = missing
+		}
+	}
+
+	// Aliases are restored after the records they belong to
+	isAlias := func(c RestoreChange) int {
+		if c.Alias != nil {
+			return 1
+		}
+		return 0
+	}
+	slices.SortFunc(changes, func(a, b RestoreChange) int {
+		return cmp.Or(
+			cmp.Compare(a.Target, b.Target),
+			cmp.Compare(isAlias(a), isAlias(b)),
+			cmp.Compare(a.name(), b.name()),
+			cmp.Compare(a.Record.Type, b.Record.Type),
+		)
+	})
+
+	if dryRun || (len(routed) == 0 && len(aliases) == 0) {
+		return changes, nil
+	}
+
+	defer p.cache.invalidate()
+	for _, t := range p.targets {
+		tc, ok := routed[t]
+		if !ok {
+			continue
+		}
+		requestid.Log(ctx).Infof("restore: restoring %d records on target '%s'", len(tc.Create)+len(tc.UpdateNew), t.name)
+		if err := p.applyChanges(ctx, t, tc); err != nil {
+			return nil, unavailable(fmt.Errorf("restore: target '%s': %w", t.name, err))
+		}
+	}
+	for _, t := range p.targets {
+		missing, ok := aliases[t]
+		if !ok {
+			continue
+		}
+		requestid.Log(ctx).Infof("restore: restoring %d aliases on target '%s'", len(missing), t.name)
+		for _, alias := range missing {
+			if err := t.backend.(aliaser).createAlias(ctx, alias); err != nil {
+				return nil, unavailable(fmt.Errorf("restore: target '%s': alias %s: %w", t.name, alias.Name, err))
+			}
+		}
+		if err := t.backend.Apply(ctx); err != nil {
+			return nil, unavailable(fmt.Errorf("restore: target '%s': %w", t.name, err))
+		}
+	}
+	return changes, nil
+}
+
+// missingAliases returns the aliases of a backup of target t missing from OPNsense.
+// Aliases of records that aren't in records, the managed records of the backup, are skipped.
+func (p *Provider) missingAliases(ctx context.Context, t *target, aliases []Alias, records map[string]Record) ([]Alias, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	a, ok := t.backend.(aliaser)
+	if !ok {
+		return nil, fmt.Errorf("the backup holds aliases for target '%s', which doesn't keep aliases", t.name)
+	}
+	live, err := a.listAliases(ctx)
+	if err != nil {
+		return nil, unavailable(fmt.Errorf("restore: target '%s': %w", t.name, err))
+	}
+	existing := make(map[string]bool, len(live))
+	for _, alias := range live {
+		existing[alias.key()] = true
+	}
+
+	var missing []Alias
+	for _, alias := range aliases {
+		if existing[alias.key()] {
+			continue
+		}
+		if _, ok := records[alias.recordKey()]; !ok {
+			requestid.Log(ctx).Warnf("restore: skipping alias %s on target '%s', %s %s isn't managed by the webhook", alias.Name, t.name, alias.RecordType, alias.Record)
+			continue
+		}
+		missing = append(missing, alias)
+	}
+	return missing, nil
+}
@@ -0,0 +1,166 @@
+package opnsense
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// roundTrip encodes backup and decodes it again, like writing it to a file and reading it back.
+func roundTrip(t *testing.T, backup *Backup) *Backup {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(backup); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBackup(&buf)
+	if err != nil {
+		t.Fatalf("DecodeBackup: %v", err)
+	}
+	return decoded
+}
+
+func restoreActions(changes []RestoreChange) []string {
+	var actions []string
+	for _, c := range changes {
+		actions = append(actions, c.Action+" "+c.name())
+	}
+	return actions
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemoryBackend(
+		memoryRecord("nas.example.com", "192.168.1.10", "external-dns"),
+		memoryRecord("router.example.com", "192.168.1.1", "set up by hand"),
+	)
+	for _, alias := range []Alias{
+		{Name: "files.example.com", Record: "nas.example.com", RecordType: "A", Enabled: true},
+		{Name: "gateway.example.com", Record: "router.example.com", RecordType: "A", Enabled: true},
+	} {
+		if err := source.createAlias(ctx, alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := ProviderConfig{OwnershipMarker: "external-dns"}
+	p := newTestProvider(t, nil, config, Target{Name: DefaultTargetName, Backend: source})
+
+	backup, err := p.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup = roundTrip(t, backup)
+	if got := backup.Targets[0]; len(got.Records) != 1 || len(got.Aliases) != 1 || got.Aliases[0].Name != "files.example.com" {
+		t.Fatalf("backup = %+v, want the managed record and its alias only", got)
+	}
+
+	// Restored to a firewall set up from scratch
+	restored := NewMemoryBackend()
+	p = newTestProvider(t, nil, config, Target{Name: DefaultTargetName, Backend: restored})
+
+	changes, err := p.Restore(ctx, backup, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"create nas.example.com", "create-alias files.example.com"}
+	if got := restoreActions(changes); !slices.Equal(got, want) {
+		t.Errorf("dry run = %v, want %v", got, want)
+	}
+	if len(restored.Records()) != 0 || len(restored.Aliases()) != 0 {
+		t.Fatal("the dry run restored records")
+	}
+
+	if _, err := p.Restore(ctx, backup, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := recordNames(restored.Records()), []string{"nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("restored records %v, want %v", got, want)
+	}
+	if got, want := restored.Aliases(), backup.Targets[0].Aliases; !slices.Equal(got, want) {
+		t.Errorf("restored aliases %v, want %v", got, want)
+	}
+
+	changes, err = p.Restore(ctx, backup, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("restoring again made changes: %v", changes)
+	}
+}
+
+func TestDecodeBackupReadsEarlierVersions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		backup string
+	}{
+		{name: "version 1", backup: `{"version":1,"createdAt":"2024-07-01T12:00:00Z","targets":[{"name":"default","records":[{"uuid":"4b7d1a3c","enabled":"1","hostname":"nas","domain":"example.com","rr":"A (IPv4 address)","server":"192.168.1.10"}]}]}`},
+		{name: "version 2", backup: `{"version":2,"createdAt":"2024-07-01T12:00:00Z","targets":[{"name":"default","records":[{"id":"4b7d1a3c","name":"nas.example.com","type":"A","target":"192.168.1.10","enabled":true}]}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backup, err := DecodeBackup(strings.NewReader(tc.backup))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Record{ID: "4b7d1a3c", Name: "nas.example.com", Type: "A", Target: "192.168.1.10", Enabled: true}
+			if len(backup.Targets) != 1 || !slices.Equal(backup.Targets[0].Records, []Record{want}) {
+				t.Errorf("DecodeBackup = %+v, want %+v", backup.Targets, want)
+			}
+		})
+	}
+
+	if _, err := DecodeBackup(strings.NewReader(`{"version":4,"targets":[]}`)); err == nil {
+		t.Error("DecodeBackup read a backup of a newer version")
+	}
+}
+
+func TestUnboundAliasesRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeUnbound(t)
+	c := newTestCluster(t, HAModeFailover, f)
+
+	if _, err := c.Create(ctx, memoryRecord("nas.example.com", "192.168.1.10", "")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Create(ctx, memoryRecord("router.example.com", "192.168.1.1", "")); err != nil {
+		t.Fatal(err)
+	}
+	files := Alias{Name: "files.example.com", Record: "nas.example.com", RecordType: "A", Enabled: true, Description: "shares"}
+	if err := c.createAlias(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	// Some OPNsense versions name the host override of an alias by its FQDN rather than its uuid
+	f.addAlias(DNSAlias{Enabled: "1", Host: "router.example.com", Hostname: "gateway", Domain: "example.com"})
+
+	aliases, err := c.listAliases(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(aliases, func(a, b Alias) int { return strings.Compare(a.Name, b.Name) })
+	gateway := Alias{Name: "gateway.example.com", Record: "router.example.com", RecordType: "A", Enabled: true}
+	if want := []Alias{files, gateway}; !slices.Equal(aliases, want) {
+		t.Fatalf("listAliases = %+v, want %+v", aliases, want)
+	}
+
+	// Recreated records get new uuids, the aliases have to follow them
+	f.clear()
+	if _, err := c.Create(ctx, memoryRecord("nas.example.com", "192.168.1.10", "")); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := c.createAlias(ctx, files); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nas := f.list()[0]
+	if got := f.listAliases(); len(got) != 1 || got[0].Host != nas.Uuid || got[0].Hostname != "files" || got[0].Description != "shares" {
+		t.Errorf("aliases = %+v, want files.example.com once, belonging to %s", got, nas.Uuid)
+	}
+
+	if err := c.createAlias(ctx, gateway); err == nil {
+		t.Error("createAlias succeeded without the host override it belongs to")
+	}
+}
@@ -0,0 +1,172 @@
+package opnsense
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errCircuitOpen is returned without contacting the firewall while its circuit breaker is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// breakerOutcome is the result of a request as far as the circuit breaker is concerned
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	// outcomeIgnored is used for requests that neither prove nor disprove the host is healthy,
+	// e.g. ones cancelled by the caller
+	outcomeIgnored
+)
+
+// circuitBreaker stops sending requests to a firewall after consecutive failures.
+// Once openDuration passed, up to halfOpenRequests probe requests are let through;
+// the first success closes the circuit again, a failure opens it for another round.
+// Every change of state starts a new generation, outcomes of requests allowed in an
+// earlier generation are ignored, so a slow request can't undo a later transition.
+type circuitBreaker struct {
+	host             string
+	threshold        int
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probes   int
+	// generation counts the changes of state
+	generation uint64
+}
+
+// newCircuitBreaker creates a breaker opening after threshold consecutive failures.
+// A threshold of zero disables the breaker.
+func newCircuitBreaker(host string, threshold int, openDuration time.Duration, halfOpenRequests int) *circuitBreaker {
+	if halfOpenRequests < 1 {
+		halfOpenRequests = 1
+	}
+	b := &circuitBreaker{
+		host:             host,
+		threshold:        threshold,
+		openDuration:     openDuration,
+		halfOpenRequests: halfOpenRequests,
+	}
+	breakerStateGauge.WithLabelValues(host).Set(float64(breakerClosed))
+	return b
+}
+
+// allow returns errCircuitOpen if no request may be sent right now.
+// Every allowed request must be followed by a call to done with the returned generation.
+func (b *circuitBreaker) allow() (uint64, error) {
+	if b.threshold <= 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.refresh() {
+	case breakerOpen:
+		return 0, fmt.Errorf("%s: %w: %w", b.host, errCircuitOpen, errUnreachable)
+	case breakerHalfOpen:
+		if b.probes >= b.halfOpenRequests {
+			return 0, fmt.Errorf("%s: %w: %w", b.host, errCircuitOpen, errUnreachable)
+		}
+		b.probes++
+	}
+	return b.generation, nil
+}
+
+// done records the outcome of a request allowed by allow in generation.
+func (b *circuitBreaker) done(generation uint64, outcome breakerOutcome) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+	switch b.state {
+	case breakerHalfOpen:
+		b.probes--
+		switch outcome {
+		case outcomeSuccess:
+			b.failures = 0
+			b.setState(breakerClosed)
+		case outcomeFailure:
+			b.open()
+		}
+	case breakerClosed:
+		switch outcome {
+		case outcomeSuccess:
+			b.failures = 0
+		case outcomeFailure:
+			b.failures++
+			if b.failures >= b.threshold {
+				b.open()
+			}
+		}
+	}
+}
+
+// refresh lets an open circuit turn half-open once openDuration passed and returns the state.
+func (b *circuitBreaker) refresh() breakerState {
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.openDuration {
+		b.setState(breakerHalfOpen)
+		b.probes = 0
+	}
+	return b.state
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	log.Infof("breaker: circuit for %s changed from %s to %s", b.host, b.state, state)
+	b.state = state
+	b.generation++
+	breakerStateGauge.WithLabelValues(b.host).Set(float64(state))
+}
+
+// status returns an error describing the breaker while it isn't closed.
+func (b *circuitBreaker) status() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.refresh()
+	if state == breakerClosed {
+		return nil
+	}
+	return fmt.Errorf("circuit breaker %s", state)
+}
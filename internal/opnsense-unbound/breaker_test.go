@@ -0,0 +1,109 @@
+package opnsense
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testOpenDuration = 20 * time.Millisecond
+
+// request lets a request through b and reports its outcome, failing the test if b refuses it.
+func request(t *testing.T, b *circuitBreaker, outcome breakerOutcome) {
+	t.Helper()
+	generation, err := b.allow()
+	if err != nil {
+		t.Fatalf("allow = %v, want the request let through", err)
+	}
+	b.done(generation, outcome)
+}
+
+func wantState(t *testing.T, b *circuitBreaker, want breakerState) {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if got := b.refresh(); got != want {
+		t.Fatalf("breaker is %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := newCircuitBreaker("opens.example.com", 3, testOpenDuration, 1)
+
+	request(t, b, outcomeFailure)
+	request(t, b, outcomeFailure)
+	request(t, b, outcomeSuccess)
+	request(t, b, outcomeFailure)
+	request(t, b, outcomeIgnored)
+	request(t, b, outcomeFailure)
+	wantState(t, b, breakerClosed)
+
+	request(t, b, outcomeFailure)
+	wantState(t, b, breakerOpen)
+	if _, err := b.allow(); !errors.Is(err, errCircuitOpen) || !errors.Is(err, errUnreachable) {
+		t.Errorf("allow = %v while open, want errCircuitOpen and errUnreachable", err)
+	}
+	if err := b.status(); err == nil {
+		t.Error("status = nil while open")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		outcome breakerOutcome
+		want    breakerState
+	}{
+		{name: "probe succeeds", outcome: outcomeSuccess, want: breakerClosed},
+		{name: "probe fails", outcome: outcomeFailure, want: breakerOpen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newCircuitBreaker("half-open.example.com", 1, testOpenDuration, 1)
+			request(t, b, outcomeFailure)
+			wantState(t, b, breakerOpen)
+
+			time.Sleep(testOpenDuration)
+			// status turns the circuit half-open by itself, without waiting for a request
+			if err := b.status(); err == nil || err.Error() != "circuit breaker half-open" {
+				t.Fatalf("status = %v once openDuration passed, want half-open", err)
+			}
+
+			generation, err := b.allow()
+			if err != nil {
+				t.Fatalf("allow = %v for the probe", err)
+			}
+			if _, err := b.allow(); !errors.Is(err, errCircuitOpen) {
+				t.Errorf("allow = %v while the probe is running, want errCircuitOpen", err)
+			}
+			b.done(generation, tc.outcome)
+			wantState(t, b, tc.want)
+		})
+	}
+}
+
+func TestCircuitBreakerIgnoresStaleOutcomes(t *testing.T) {
+	b := newCircuitBreaker("stale.example.com", 1, testOpenDuration, 1)
+
+	// A slow request allowed while closed succeeds after another one opened the circuit
+	slow, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(t, b, outcomeFailure)
+	b.done(slow, outcomeSuccess)
+	wantState(t, b, breakerOpen)
+
+	// A slow request allowed before the circuit opened fails after a probe closed it again
+	time.Sleep(testOpenDuration)
+	request(t, b, outcomeSuccess)
+	b.done(slow, outcomeFailure)
+	wantState(t, b, breakerClosed)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("disabled.example.com", 0, testOpenDuration, 1)
+	for range 10 {
+		request(t, b, outcomeFailure)
+	}
+	wantState(t, b, breakerClosed)
+}
@@ -0,0 +1,114 @@
+package opnsense
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+type cacheBypassKey struct{}
+
+// WithCacheBypass returns a context that makes Records skip the record cache
+// and fetch fresh records from OPNsense.
+func WithCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+// recordCache holds the result of the last Records call for a limited time.
+// A ttl of zero disables the cache.
+type recordCache struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	endpoints  []*endpoint.Endpoint
+	expires    time.Time
+	generation uint64
+}
+
+// get returns a copy of the cached endpoints, if they haven't expired yet.
+func (c *recordCache) get() ([]*endpoint.Endpoint, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.endpoints == nil || time.Now().After(c.expires) {
+		cacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+
+	cacheRequests.WithLabelValues("hit").Inc()
+	return copyEndpoints(c.endpoints), true
+}
+
+// begin returns a token that has to be passed to set, so that records fetched
+// before an invalidation are never cached.
+func (c *recordCache) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// set stores a copy of endpoints, unless the cache was invalidated since begin was called.
+func (c *recordCache) set(token uint64, endpoints []*endpoint.Endpoint) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token != c.generation {
+		return
+	}
+	c.endpoints = copyEndpoints(endpoints)
+	if c.endpoints == nil {
+		c.endpoints = []*endpoint.Endpoint{}
+	}
+	c.expires = time.Now().Add(c.ttl)
+}
+
+// inherit takes over the endpoints cached by previous, as long as they are fresh.
+func (c *recordCache) inherit(previous *recordCache) {
+	previous.mu.Lock()
+	endpoints, expires := copyEndpoints(previous.endpoints), previous.expires
+	previous.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.endpoints, c.expires = endpoints, expires
+	if limit := time.Now().Add(c.ttl); c.expires.After(limit) {
+		c.expires = limit
+	}
+}
+
+// invalidate drops the cached endpoints.
+func (c *recordCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.endpoints = nil
+}
+
+func copyEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if endpoints == nil {
+		return nil
+	}
+	result := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		result = append(result, ep.DeepCopy())
+	}
+	return result
+}
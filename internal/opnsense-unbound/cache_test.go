@@ -0,0 +1,128 @@
+package opnsense
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestRecordCacheExpires(t *testing.T) {
+	c := &recordCache{ttl: 20 * time.Millisecond}
+	c.set(c.begin(), []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")})
+
+	endpoints, ok := c.get()
+	if !ok || len(endpoints) != 1 {
+		t.Fatalf("get = %v, %v right after set, want the endpoint", endpoints, ok)
+	}
+	// Callers get a copy, changing it doesn't change the cache
+	endpoints[0].Targets = endpoint.NewTargets("192.168.1.99")
+	if endpoints, _ := c.get(); endpoints[0].Targets[0] != "192.168.1.10" {
+		t.Errorf("the cached endpoint was changed through a returned copy: %v", endpoints[0])
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get(); ok {
+		t.Error("get hit the cache after the ttl")
+	}
+}
+
+func TestRecordCacheDropsFetchesRacingAnInvalidation(t *testing.T) {
+	c := &recordCache{ttl: time.Minute}
+
+	token := c.begin()
+	c.invalidate()
+	c.set(token, []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")})
+	if endpoints, ok := c.get(); ok {
+		t.Errorf("get = %v, want the records fetched before the invalidation dropped", endpoints)
+	}
+}
+
+func TestProviderRecordsCache(t *testing.T) {
+	target, backend := memoryTarget(memoryRecord("nas.example.com", "192.168.1.10", ""))
+	p := newTestProvider(t, nil, ProviderConfig{CacheTTL: time.Minute}, target)
+	ctx := context.Background()
+
+	if _, err := p.Records(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Changed behind the back of the provider, the cache keeps answering until it is invalidated or bypassed
+	if _, err := backend.Create(ctx, memoryRecord("app.example.com", "192.168.1.20", "")); err != nil {
+		t.Fatal(err)
+	}
+	records := func(ctx context.Context) []string {
+		t.Helper()
+		endpoints, err := p.Records(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return endpointNames(endpoints)
+	}
+	if got, want := records(ctx), []string{"nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v, want the cached %v", got, want)
+	}
+	if got, want := records(WithCacheBypass(ctx)), []string{"app.example.com", "nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v bypassing the cache, want %v", got, want)
+	}
+
+	err := p.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", "A", "192.168.1.30")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records(ctx), []string{"app.example.com", "nas.example.com", "www.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v after ApplyChanges, want %v", got, want)
+	}
+}
+
+// pausingList is a backend whose next List call reads the records, then waits until release is closed.
+type pausingList struct {
+	*MemoryBackend
+	listed  chan struct{}
+	release chan struct{}
+}
+
+func (b *pausingList) List(ctx context.Context) ([]Record, error) {
+	records, err := b.MemoryBackend.List(ctx)
+	if b.listed != nil {
+		close(b.listed)
+		<-b.release
+		b.listed = nil
+	}
+	return records, err
+}
+
+func TestProviderRecordsRacingApplyChangesAreNotCached(t *testing.T) {
+	backend := &pausingList{MemoryBackend: NewMemoryBackend(memoryRecord("nas.example.com", "192.168.1.10", ""))}
+	p := newTestProvider(t, nil, ProviderConfig{CacheTTL: time.Minute}, Target{Name: DefaultTargetName, Backend: backend})
+	ctx := context.Background()
+
+	backend.listed, backend.release = make(chan struct{}), make(chan struct{})
+	listed := backend.listed
+	fetched := make(chan error)
+	go func() {
+		_, err := p.Records(ctx)
+		fetched <- err
+	}()
+	<-listed
+
+	// The batch is applied while Records holds the records read before it
+	err := p.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(backend.release)
+	if err := <-fetched; err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints, err := p.Records(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := endpointNames(endpoints), []string{"app.example.com", "nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v, want %v rather than the records read before the batch", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// CheckResult is the outcome of a single check against a single host.
+type CheckResult struct {
+	Target string
+	Host   string
+	Check  string
+	Err    error
+}
+
+// Check verifies that every host of every target can be reached, accepts the credentials
+// and grants the privileges the webhook needs. Nothing is changed on the hosts:
+// OPNsense grants privileges per API module, so reading the overrides proves
+// that they may be changed as well.
+func (p *Provider) Check(ctx context.Context) []CheckResult {
+	var results []CheckResult
+	for _, t := range p.targets {
+		if c, ok := t.backend.(checker); ok {
+			results = append(results, c.check(ctx, t.name)...)
+			continue
+		}
+
+		err := t.backend.Login(ctx)
+		results = append(results, CheckResult{Target: t.name, Check: "login", Err: err})
+		if errors.Is(err, errUnreachable) {
+			continue
+		}
+		_, err = t.backend.List(ctx)
+		results = append(results, CheckResult{Target: t.name, Check: "records", Err: err})
+	}
+	return results
+}
+
+// check runs the checks of Provider.Check against every member.
+func (c *clusterClient) check(ctx context.Context, target string) []CheckResult {
+	var results []CheckResult
+	for _, m := range c.members {
+		err := m.login(ctx)
+		results = append(results, CheckResult{Target: target, Host: m.host, Check: "service (api/unbound/service)", Err: describeCheckError(err, "api/unbound/service")})
+		if errors.Is(err, errUnreachable) {
+			continue
+		}
+
+		_, err = m.GetHostOverrides(ctx)
+		results = append(results, CheckResult{Target: target, Host: m.host, Check: "host overrides (api/unbound/settings)", Err: describeCheckError(err, "api/unbound/settings")})
+	}
+	return results
+}
+
+// describeCheckError explains the status codes OPNsense answers authentication and authorization failures with.
+func describeCheckError(err error, module string) error {
+	var status *statusError
+	if !errors.As(err, &status) {
+		return err
+	}
+
+	switch status.code {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("the api key or secret was rejected: %w", err)
+	case http.StatusForbidden:
+		return fmt.Errorf("the api user lacks the privileges for %s: %w", module, err)
+	default:
+		return err
+	}
+}
@@ -2,32 +2,64 @@ package opnsense
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
-	"sigs.k8s.io/external-dns/endpoint"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const emptyJSONObject = "{}"
 
+// errUnreachable is returned when a request could not reach the firewall at all
+var errUnreachable = errors.New("host unreachable")
+
+// statusError is returned when the firewall answered a request with anything but 200 OK
+type statusError struct {
+	method string
+	url    string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("doRequest: %s request to %s was not successful: %d", e.method, e.url, e.code)
+}
+
 // httpClient is the DNS provider client.
 type httpClient struct {
 	*Config
 	*http.Client
+	host    string
 	baseURL *url.URL
+	limiter *requestLimiter
+	breaker *circuitBreaker
+	clientOptions
+}
+
+// clientOptions are the settings a client takes from the provider rather than from its target's Config.
+type clientOptions struct {
+	// target is the name of the target the client belongs to
+	target string
+	// audit records every change sent to the host
+	audit *auditLog
 }
 
-// newOpnsenseClient creates a new DNS provider client.
-func newOpnsenseClient(config *Config) (*httpClient, error) {
-	u, err := url.Parse(config.Host)
+// newOpnsenseClient creates a new DNS provider client for a single host.
+func newOpnsenseClient(config *Config, host string, opts clientOptions) (*httpClient, error) {
+	u, err := url.Parse(host)
 	if err != nil {
 		return nil, fmt.Errorf("parse url: %w", err)
 	}
@@ -43,24 +75,25 @@ func newOpnsenseClient(config *Config) (*httpClient, error) {
 	client := &httpClient{
 		Config: config,
 		Client: &http.Client{
-			Transport: &http.Transport{
+			Transport: otelhttp.NewTransport(&http.Transport{
 				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipTLSVerify},
-			},
+			}),
 		},
-		baseURL: u,
-	}
-
-	if err := client.login(); err != nil {
-		return nil, err
+		host:          host,
+		baseURL:       u,
+		limiter:       newRequestLimiter(host, config.RateLimit, config.RateBurst, config.MaxConcurrentRequests),
+		breaker:       newCircuitBreaker(host, config.BreakerThreshold, config.BreakerOpenDuration, config.BreakerHalfOpenRequests),
+		clientOptions: opts,
 	}
 
 	return client, nil
 }
 
 // login performs a basic call to validate credentials
-func (c *httpClient) login() error {
+func (c *httpClient) login(ctx context.Context) error {
 	// Perform the test call by getting service status
 	resp, err := c.doRequest(
+		ctx,
 		http.MethodGet,
 		"service/status",
 		nil,
@@ -74,7 +107,7 @@ func (c *httpClient) login() error {
 	// Check if the login was successful
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		log.Errorf("login: failed: %s, response: %s", resp.Status, string(respBody))
+		requestid.Log(ctx).Errorf("login: failed: %s, response: %s", resp.Status, string(respBody))
 		return fmt.Errorf("login: failed: %s", resp.Status)
 	}
 
@@ -82,30 +115,71 @@ func (c *httpClient) login() error {
 }
 
 // doRequest makes an HTTP request to the Opnsense firewall.
-func (c *httpClient) doRequest(method, path string, body io.Reader) (*http.Response, error) {
+func (c *httpClient) doRequest(ctx context.Context, method, path string, body io.Reader) (resp *http.Response, err error) {
+	ctx, span := startSpan(ctx, "opnsense "+apiPathLabel(path), trace.WithAttributes(
+		attribute.String("opnsense.host", c.host),
+		attribute.String("http.request.method", method),
+	))
+	defer func() { endSpan(span, err) }()
+
 	u := c.baseURL.ResolveReference(&url.URL{
 		Path: path,
 	})
 
-	log.Debugf("doRequest: making %s request to %s", method, u)
+	requestid.Log(ctx).Debugf("doRequest: making %s request to %s", method, u)
 
-	req, err := http.NewRequest(method, u.String(), body)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
 
 	c.setHeaders(req)
 
-	resp, err := c.Client.Do(req)
+	generation, err := c.breaker.allow()
 	if err != nil {
-		return nil, err
+		observeAPIRequest(c.host, path, apiResultRejected, 0)
+		return nil, fmt.Errorf("doRequest: %s request to %s not sent: %w", method, u, err)
 	}
 
-	log.Debugf("doRequest: response code from %s request to %s: %d", method, u, resp.StatusCode)
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		c.breaker.done(generation, outcomeIgnored)
+		observeAPIRequest(c.host, path, apiResultRejected, 0)
+		return nil, fmt.Errorf("doRequest: waiting for rate limiter: %w", err)
+	}
+
+	start := time.Now()
+	resp, err = c.Client.Do(req)
+	if err != nil {
+		release()
+		if ctx.Err() != nil {
+			c.breaker.done(generation, outcomeIgnored)
+			observeAPIRequest(c.host, path, apiResultAborted, time.Since(start))
+			return nil, fmt.Errorf("doRequest: %s request to %s aborted: %w", method, u, err)
+		}
+		c.breaker.done(generation, outcomeFailure)
+		observeAPIRequest(c.host, path, apiResultUnreachable, time.Since(start))
+		return nil, fmt.Errorf("doRequest: %s request to %s failed: %w: %w", method, u, errUnreachable, err)
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+
+	result := apiResultSuccess
+	if resp.StatusCode != http.StatusOK {
+		result = apiResultHTTPError
+	}
+	observeAPIRequest(c.host, path, result, time.Since(start))
+
+	requestid.Log(ctx).Debugf("doRequest: response code from %s request to %s: %d", method, u, resp.StatusCode)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		c.breaker.done(generation, outcomeFailure)
+	} else {
+		c.breaker.done(generation, outcomeSuccess)
+	}
 
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
-		return nil, fmt.Errorf("doRequest: %s request to %s was not successful: %d", method, u, resp.StatusCode)
+		return nil, &statusError{method: method, url: u.String(), code: resp.StatusCode}
 	}
 
 	return resp, nil
@@ -113,8 +187,9 @@ func (c *httpClient) doRequest(method, path string, body io.Reader) (*http.Respo
 
 // GetHostOverrides retrieves the list of HostOverrides from the Opnsense Firewall's Unbound API.
 // These are equivalent to A or AAAA records
-func (c *httpClient) GetHostOverrides() ([]DNSRecord, error) {
+func (c *httpClient) GetHostOverrides(ctx context.Context) ([]DNSRecord, error) {
 	resp, err := c.doRequest(
+		ctx,
 		http.MethodGet,
 		"settings/searchHostOverride",
 		nil,
@@ -129,41 +204,41 @@ func (c *httpClient) GetHostOverrides() ([]DNSRecord, error) {
 		return nil, err
 	}
 
-	log.Debugf("gethost: retrieved records: %+v", records.Rows)
+	requestid.Log(ctx).Debugf("gethost: retrieved records: %+v", records.Rows)
 
 	return records.Rows, nil
 }
 
-// CreateHostOverride creates a new DNS A or AAAA record in the Opnsense Firewall's Unbound API.
-func (c *httpClient) CreateHostOverride(endpoint *endpoint.Endpoint) (*DNSRecord, error) {
-	log.Debugf("create: Try pulling pre-existing Unbound %s record: %s", endpoint.RecordType, endpoint.DNSName)
-	lookup, err := c.lookupHostOverrideIdentifier(endpoint.DNSName, endpoint.RecordType)
+// CreateHostOverride creates a new DNS A or AAAA record in the Opnsense Firewall's Unbound API,
+// unless a record with the same name and type exists already, which is returned instead.
+func (c *httpClient) CreateHostOverride(ctx context.Context, record DNSRecord) (_ *DNSRecord, err error) {
+	name := JoinUnboundFQDN(record.Hostname, record.Domain)
+	record.Uuid = ""
+	record.Rr = PruneUnboundType(record.Rr)
+
+	requestid.Log(ctx).Debugf("create: Try pulling pre-existing Unbound %s record: %s", record.Rr, name)
+	lookup, err := c.lookupHostOverrideIdentifier(ctx, name, record.Rr, "")
 	if err != nil {
 		return nil, err
 	}
 
 	if lookup != nil {
-		log.Debugf("create: Found uuid: %s", lookup.Uuid)
-		log.Debugf("create: Found existing %s record for %s : %s", endpoint.RecordType, endpoint.DNSName, lookup.Uuid)
+		requestid.Log(ctx).Debugf("create: Found uuid: %s", lookup.Uuid)
+		requestid.Log(ctx).Debugf("create: Found existing %s record for %s : %s", record.Rr, name, lookup.Uuid)
 		return lookup, nil
 	}
 
-	splitHost := SplitUnboundFQDN(endpoint.DNSName)
+	event := AuditEvent{Action: AuditActionAdd, Name: name, Type: record.Rr, After: &record}
+	defer func() { c.auditEvent(ctx, event, err) }()
 
-	jsonBody, err := json.Marshal(unboundAddHostOverride{
-		Host: DNSRecord{
-			Enabled:  "1",
-			Rr:       endpoint.RecordType,
-			Server:   endpoint.Targets[0],
-			Hostname: splitHost[0],
-			Domain:   splitHost[1],
-		}})
+	jsonBody, err := json.Marshal(unboundAddHostOverride{Host: record})
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debugf("create: POST: %s", string(jsonBody))
+	requestid.Log(ctx).Debugf("create: POST: %s", string(jsonBody))
 	resp, err := c.doRequest(
+		ctx,
 		http.MethodPost,
 		"settings/addHostOverride",
 		bytes.NewReader(jsonBody),
@@ -173,65 +248,255 @@ func (c *httpClient) CreateHostOverride(endpoint *endpoint.Endpoint) (*DNSRecord
 	}
 	defer resp.Body.Close()
 
-	// TODO: Better error handling if API returns:
-	// {"result":"failed"}
-	//if resp.Body != nil && resp.Body
-
-	var record unboundAddHostOverride
-	if err = json.NewDecoder(resp.Body).Decode(&record); err != nil {
-		return nil, err
+	result, err := decodeSaveResult(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("create: %s record %s: %w", record.Rr, name, err)
 	}
-	log.Debugf("create: created record: %+v", record)
+	event.UUID, record.Uuid = result.UUID, result.UUID
+	requestid.Log(ctx).Debugf("create: created record: %+v", result)
 
 	return nil, nil
 }
 
+// decodeSaveResult decodes the answer to adding or setting a host override.
+// OPNsense answers a save it rejected, e.g. failing validation, with 200 OK as well.
+func decodeSaveResult(body io.Reader) (*unboundSaveResult, error) {
+	var result unboundSaveResult
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding the result: %w", err)
+	}
+	if result.Result != "saved" {
+		if len(result.Validations) > 0 {
+			return nil, fmt.Errorf("opnsense didn't save the record, result '%s': %v", result.Result, result.Validations)
+		}
+		return nil, fmt.Errorf("opnsense didn't save the record, result '%s'", result.Result)
+	}
+	return &result, nil
+}
+
 // DeleteHostOverride deletes a DNS record from the Opnsense Firewall's Unbound API.
-func (c *httpClient) DeleteHostOverride(endpoint *endpoint.Endpoint) error {
-	log.Debugf("delete: Deleting record %+v", endpoint)
-	lookup, err := c.lookupHostOverrideIdentifier(endpoint.DNSName, endpoint.RecordType)
+// Only a record carrying every word of the description of record is deleted, e.g. the ownership marker.
+func (c *httpClient) DeleteHostOverride(ctx context.Context, record DNSRecord) (err error) {
+	name, recordType := JoinUnboundFQDN(record.Hostname, record.Domain), PruneUnboundType(record.Rr)
+	requestid.Log(ctx).Debugf("delete: Deleting record %+v", record)
+	lookup, err := c.lookupHostOverrideIdentifier(ctx, name, recordType, record.Description)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("delete: Found match %s", lookup.Uuid)
+	if lookup == nil {
+		requestid.Log(ctx).Debugf("delete: No %s record found for %s, nothing to delete", recordType, name)
+		return nil
+	}
+
+	requestid.Log(ctx).Debugf("delete: Found match %s", lookup.Uuid)
+
+	event := AuditEvent{Action: AuditActionDelete, Name: name, Type: recordType, UUID: lookup.Uuid, Before: lookup}
+	defer func() { c.auditEvent(ctx, event, err) }()
 
-	log.Debugf("delete: Sending POST %s", lookup.Uuid)
-	if _, err = c.doRequest(
+	requestid.Log(ctx).Debugf("delete: Sending POST %s", lookup.Uuid)
+	resp, err := c.doRequest(
+		ctx,
 		http.MethodPost,
 		path.Join("settings/delHostOverride", lookup.Uuid),
 		strings.NewReader(emptyJSONObject),
-	); err != nil {
+	)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return resp.Body.Close()
 }
 
 // lookupHostOverrideIdentifier finds a HostOverride in the Opnsense Firewall's Unbound API.
-func (c *httpClient) lookupHostOverrideIdentifier(key, recordType string) (*DNSRecord, error) {
-	records, err := c.GetHostOverrides()
+// Records not carrying every word of description are skipped.
+func (c *httpClient) lookupHostOverrideIdentifier(ctx context.Context, key, recordType, description string) (*DNSRecord, error) {
+	records, err := c.GetHostOverrides(ctx)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug("lookup: Splitting FQDN")
+	requestid.Log(ctx).Debug("lookup: Splitting FQDN")
 	splitHost := SplitUnboundFQDN(key)
 
 	for _, r := range records {
-		log.Debugf("lookup: Checking record: Host=%s, Domain=%s, Type=%s, UUID=%s", r.Hostname, r.Domain, EmbellishUnboundType(r.Rr), r.Uuid)
+		requestid.Log(ctx).Debugf("lookup: Checking record: Host=%s, Domain=%s, Type=%s, UUID=%s", r.Hostname, r.Domain, EmbellishUnboundType(r.Rr), r.Uuid)
+		if !containsWords(r.Description, description) {
+			continue
+		}
 		if r.Hostname == splitHost[0] && r.Domain == splitHost[1] && EmbellishUnboundType(r.Rr) == EmbellishUnboundType(recordType) {
-			log.Debugf("lookup: UUID Match Found: %s", r.Uuid)
+			requestid.Log(ctx).Debugf("lookup: UUID Match Found: %s", r.Uuid)
 			return &r, nil
 		}
 	}
-	log.Debugf("lookup: No matching record found for Host=%s, Domain=%s, Type=%s", splitHost[0], splitHost[1], EmbellishUnboundType(recordType))
+	requestid.Log(ctx).Debugf("lookup: No matching record found for Host=%s, Domain=%s, Type=%s", splitHost[0], splitHost[1], EmbellishUnboundType(recordType))
 	return nil, nil
 }
 
+// UpdateHostOverride replaces the HostOverride matching old with record, see Backend.Update.
+// It is looked up by name, type and address since uuids differ between the hosts of a cluster.
+func (c *httpClient) UpdateHostOverride(ctx context.Context, old, record Record) (err error) {
+	records, err := c.GetHostOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		current := r.record()
+		if !current.matches(old) {
+			continue
+		}
+
+		updated := hostOverride(record)
+		updated.Uuid = ""
+		updated.Mx, updated.MxPrio = r.Mx, r.MxPrio
+		updated.Description = mergeDescription(r.Description, record.Description)
+		current.ID = ""
+		if updated.record() == current {
+			requestid.Log(ctx).Debugf("update: %s record %s is up to date", current.Type, current.Name)
+			return nil
+		}
+
+		before := r
+		event := AuditEvent{Action: AuditActionSet, Name: record.Name, Type: updated.Rr, UUID: r.Uuid, Before: &before, After: &updated}
+		defer func() { c.auditEvent(ctx, event, err) }()
+
+		jsonBody, err := json.Marshal(unboundAddHostOverride{Host: updated})
+		if err != nil {
+			return err
+		}
+
+		requestid.Log(ctx).Debugf("update: POST %s: %s", r.Uuid, string(jsonBody))
+		resp, err := c.doRequest(ctx, http.MethodPost, path.Join("settings/setHostOverride", r.Uuid), bytes.NewReader(jsonBody))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if _, err := decodeSaveResult(resp.Body); err != nil {
+			return fmt.Errorf("update: %s record %s: %w", updated.Rr, record.Name, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("update: no %s record %s pointing to %s found: %w", old.Type, old.Name, old.Target, errRecordNotFound)
+}
+
+// GetHostAliases retrieves the aliases of the HostOverrides from the Opnsense Firewall's Unbound API.
+func (c *httpClient) GetHostAliases(ctx context.Context) ([]DNSAlias, error) {
+	resp, err := c.doRequest(ctx, http.MethodGet, "settings/searchHostAlias", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var aliases unboundAliasList
+	if err = json.NewDecoder(resp.Body).Decode(&aliases); err != nil {
+		return nil, err
+	}
+	return aliases.Rows, nil
+}
+
+// hostAliases returns the aliases along with the name and type of the HostOverride they belong to.
+// Depending on the OPNsense version the search names the HostOverride by its uuid or its FQDN,
+// aliases of HostOverrides that can't be found are skipped.
+func (c *httpClient) hostAliases(ctx context.Context) ([]Alias, error) {
+	overrides, err := c.GetHostOverrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.GetHostAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byUUID := make(map[string]DNSRecord, len(overrides))
+	byName := make(map[string]DNSRecord, len(overrides))
+	for _, r := range overrides {
+		byUUID[r.Uuid] = r
+		name := JoinUnboundFQDN(r.Hostname, r.Domain)
+		if _, ok := byName[name]; !ok {
+			byName[name] = r
+		}
+	}
+
+	aliases := make([]Alias, 0, len(rows))
+	for _, a := range rows {
+		name := JoinUnboundFQDN(a.Hostname, a.Domain)
+		host, ok := byUUID[a.Host]
+		if !ok {
+			host, ok = byName[strings.TrimSuffix(a.Host, ".")]
+		}
+		if !ok {
+			requestid.Log(ctx).Debugf("aliases: skipping alias %s of unknown host override '%s'", name, a.Host)
+			continue
+		}
+		aliases = append(aliases, Alias{
+			Name:        name,
+			Record:      JoinUnboundFQDN(host.Hostname, host.Domain),
+			RecordType:  PruneUnboundType(host.Rr),
+			Enabled:     a.Enabled == "1",
+			Description: a.Description,
+		})
+	}
+	return aliases, nil
+}
+
+// CreateHostAlias adds alias to the HostOverride it belongs to, unless it exists already.
+func (c *httpClient) CreateHostAlias(ctx context.Context, alias Alias) (err error) {
+	existing, err := c.hostAliases(ctx)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(existing, func(a Alias) bool { return a.key() == alias.key() }) {
+		requestid.Log(ctx).Debugf("alias: %s of %s exists already", alias.Name, alias.Record)
+		return nil
+	}
+
+	host, err := c.lookupHostOverrideIdentifier(ctx, alias.Record, alias.RecordType, "")
+	if err != nil {
+		return err
+	}
+	if host == nil {
+		return fmt.Errorf("alias: %s: no %s record %s found: %w", alias.Name, alias.RecordType, alias.Record, errRecordNotFound)
+	}
+
+	splitHost := SplitUnboundFQDN(alias.Name)
+	row := DNSAlias{Enabled: "0", Host: host.Uuid, Hostname: splitHost[0], Description: alias.Description}
+	if len(splitHost) > 1 {
+		row.Domain = splitHost[1]
+	}
+	if alias.Enabled {
+		row.Enabled = "1"
+	}
+
+	event := AuditEvent{Action: AuditActionAdd, Name: alias.Name, Type: AuditTypeAlias}
+	defer func() { c.auditEvent(ctx, event, err) }()
+
+	jsonBody, err := json.Marshal(unboundAddHostAlias{Alias: row})
+	if err != nil {
+		return err
+	}
+	resp, err := c.doRequest(ctx, http.MethodPost, "settings/addHostAlias", bytes.NewReader(jsonBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result, err := decodeSaveResult(resp.Body)
+	if err != nil {
+		return fmt.Errorf("alias: %s of %s: %w", alias.Name, alias.Record, err)
+	}
+	event.UUID = result.UUID
+	return nil
+}
+
 // ReconfigureUnbound performs a reconfigure action in Unbound after editing records
-func (c *httpClient) ReconfigureUnbound() error {
+func (c *httpClient) ReconfigureUnbound(ctx context.Context) (err error) {
+	defer func() { c.auditEvent(ctx, AuditEvent{Action: AuditActionReconfigure}, err) }()
+
 	// Perform the reconfigure
 	resp, err := c.doRequest(
+		ctx,
 		http.MethodPost,
 		"service/reconfigure",
 		strings.NewReader(emptyJSONObject),
@@ -245,7 +510,7 @@ func (c *httpClient) ReconfigureUnbound() error {
 	// Check if the login was successful
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		log.Errorf("reconfigure: login failed: %s, response: %s", resp.Status, string(respBody))
+		requestid.Log(ctx).Errorf("reconfigure: login failed: %s, response: %s", resp.Status, string(respBody))
 		return fmt.Errorf("reconfigure: unbound failed: %s", resp.Status)
 	}
 
@@ -258,9 +523,12 @@ func (c *httpClient) setHeaders(req *http.Request) {
 	opnsenseAuth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", c.Config.Key, c.Config.Secret)))
 	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", opnsenseAuth))
 	req.Header.Add("Accept", "application/json")
+	if id := requestid.FromContext(req.Context()); id != "" {
+		req.Header.Add(requestid.Header, id)
+	}
 	if req.Method != http.MethodGet {
 		req.Header.Add("Content-Type", "application/json; charset=utf-8")
 	}
 	// Log the request URL
-	log.Debugf("headers: Requesting %s", req.URL)
+	requestid.Log(req.Context()).Debugf("headers: Requesting %s", req.URL)
 }
@@ -0,0 +1,95 @@
+package opnsense
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestClient(t *testing.T, f *fakeUnbound) *httpClient {
+	t.Helper()
+	c, err := newOpnsenseClient(&Config{Key: "key", Secret: "secret"}, f.URL, clientOptions{target: DefaultTargetName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUpdateHostOverrideKeepsTheUUIDAndDescription(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeUnbound(t)
+	c := newTestClient(t, f)
+
+	if _, err := c.CreateHostOverride(ctx, hostOverride(memoryRecord("nas.example.com", "192.168.1.10", "storage external-dns"))); err != nil {
+		t.Fatal(err)
+	}
+	before := f.list()[0]
+
+	old := memoryRecord("nas.example.com", "192.168.1.10", "external-dns")
+	if err := c.UpdateHostOverride(ctx, old, memoryRecord("nas.example.com", "192.168.1.11", "external-dns")); err != nil {
+		t.Fatal(err)
+	}
+
+	after := f.list()
+	if len(after) != 1 {
+		t.Fatalf("the fake holds %d records, want 1", len(after))
+	}
+	if after[0].Uuid != before.Uuid || after[0].Server != "192.168.1.11" || after[0].Description != "storage external-dns" {
+		t.Errorf("updated host override = %+v, want %s pointing to 192.168.1.11 keeping its description", after[0], before.Uuid)
+	}
+
+	err := c.UpdateHostOverride(ctx, old, memoryRecord("nas.example.com", "192.168.1.12", "external-dns"))
+	if !errors.Is(err, errRecordNotFound) {
+		t.Errorf("updating a record that is gone returned %v, want errRecordNotFound", err)
+	}
+}
+
+func TestRejectedSavesFailAndAreAuditedAsFailures(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(&ProviderConfig{AuditLog: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	f := newFakeUnbound(t)
+	c, err := newOpnsenseClient(&Config{Key: "key", Secret: "secret"}, f.URL, clientOptions{target: DefaultTargetName, audit: audit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := memoryRecord("nas.example.com", "192.168.1.10", "external-dns")
+	if _, err := c.CreateHostOverride(ctx, hostOverride(record)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.setRejectSaves(true)
+	if _, err := c.CreateHostOverride(ctx, hostOverride(memoryRecord("app.example.com", "not an address", "external-dns"))); err == nil {
+		t.Error("creating a record OPNsense rejected succeeded")
+	}
+	if err := c.UpdateHostOverride(ctx, record, memoryRecord("nas.example.com", "not an address", "external-dns")); err == nil {
+		t.Error("updating a record OPNsense rejected succeeded")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outcomes []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, event.Action+" "+event.Outcome)
+	}
+	want := []string{"add success", "add failure", "set failure"}
+	if !slices.Equal(outcomes, want) {
+		t.Errorf("audited %v, want %v", outcomes, want)
+	}
+}
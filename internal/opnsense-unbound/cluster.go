@@ -0,0 +1,416 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	log "github.com/sirupsen/logrus"
+)
+
+// member is a single firewall of a cluster together with its last known health.
+type member struct {
+	*httpClient
+
+	mu      sync.Mutex
+	lastErr error
+	retryAt time.Time
+	// stale is set when the member missed a write in HAModeAll and cleared once it was reconciled
+	stale bool
+	// written is when the member last took a write in HAModeAll
+	written time.Time
+}
+
+// clusterClient spreads requests over one or more firewalls, e.g. a CARP pair.
+type clusterClient struct {
+	mode          string
+	retryInterval time.Duration
+	members       []*member
+}
+
+// newClusterClient creates a client for every configured host.
+func newClusterClient(config *Config, opts clientOptions) (*clusterClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("cluster: %w", err)
+	}
+
+	c := &clusterClient{
+		mode:          config.HAMode,
+		retryInterval: config.HostRetryInterval,
+	}
+
+	for _, host := range config.Hosts {
+		client, err := newOpnsenseClient(config, host, opts)
+		if err != nil {
+			return nil, fmt.Errorf("cluster: host %s: %w", host, err)
+		}
+		c.members = append(c.members, &member{httpClient: client})
+	}
+
+	return c, nil
+}
+
+// Login logs in to every member and fails only if none of them accepted the credentials.
+func (c *clusterClient) Login(ctx context.Context) error {
+	var errs []error
+	for _, m := range c.members {
+		if err := m.login(ctx); err != nil {
+			requestid.Log(ctx).Warnf("cluster: login to %s failed: %v", m.host, err)
+			c.markDown(m, err)
+			errs = append(errs, err)
+			continue
+		}
+		c.markUp(m)
+	}
+
+	if len(errs) == len(c.members) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// observe records the outcome of a request against a member.
+// Only failures to reach the host at all mark it as down.
+func (c *clusterClient) observe(m *member, err error) {
+	switch {
+	case err == nil:
+		c.markUp(m)
+	case errors.Is(err, errUnreachable):
+		c.markDown(m, err)
+	}
+}
+
+func (c *clusterClient) markUp(m *member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lastErr != nil {
+		log.Infof("cluster: host %s is reachable again", m.host)
+	}
+	m.lastErr = nil
+	m.retryAt = time.Time{}
+	hostUp.WithLabelValues(m.host).Set(1)
+}
+
+func (c *clusterClient) markDown(m *member, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lastErr == nil {
+		log.Warnf("cluster: marking host %s as down: %v", m.host, err)
+	}
+	m.lastErr = err
+	m.retryAt = time.Now().Add(c.retryInterval)
+	hostUp.WithLabelValues(m.host).Set(0)
+}
+
+// available returns the members worth sending a request to, in configured order.
+// Members that recently failed are skipped until their retry interval passed,
+// unless no other member is left.
+func (c *clusterClient) available() []*member {
+	now := time.Now()
+	var up []*member
+	for _, m := range c.members {
+		m.mu.Lock()
+		if m.lastErr == nil || now.After(m.retryAt) {
+			up = append(up, m)
+		}
+		m.mu.Unlock()
+	}
+
+	if len(up) == 0 {
+		return c.members
+	}
+	return up
+}
+
+// preferred returns the available members, those that didn't miss any write first.
+func (c *clusterClient) preferred() []*member {
+	var fresh, stale []*member
+	for _, m := range c.available() {
+		if m.isStale() {
+			stale = append(stale, m)
+			continue
+		}
+		fresh = append(fresh, m)
+	}
+	return append(fresh, stale...)
+}
+
+func (m *member) isStale() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stale
+}
+
+func (m *member) setStale(stale bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stale = stale
+}
+
+func (m *member) lastWritten() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.written
+}
+
+func (m *member) setWritten(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.written = t
+}
+
+// first runs fn against the first member that can be reached.
+func (c *clusterClient) first(ctx context.Context, fn func(*httpClient) error) error {
+	var err error
+	for _, m := range c.preferred() {
+		err = fn(m.httpClient)
+		c.observe(m, err)
+		if !errors.Is(err, errUnreachable) {
+			return err
+		}
+		requestid.Log(ctx).Warnf("cluster: host %s unreachable, trying next host", m.host)
+	}
+	return err
+}
+
+// write runs fn against the cluster according to the configured ha mode.
+func (c *clusterClient) write(ctx context.Context, fn func(*httpClient) error) error {
+	if c.mode != HAModeAll {
+		return c.first(ctx, fn)
+	}
+
+	available := c.available()
+	for _, m := range c.members {
+		if !slices.Contains(available, m) {
+			m.setStale(true)
+		}
+	}
+
+	var errs []error
+	reached := 0
+	for _, m := range available {
+		err := fn(m.httpClient)
+		c.observe(m, err)
+		if errors.Is(err, errUnreachable) {
+			requestid.Log(ctx).Warnf("cluster: host %s unreachable, it will be reconciled once it is back", m.host)
+			m.setStale(true)
+			continue
+		}
+		reached++
+		if err != nil {
+			// The host may now differ from the ones that took the write, it must not be the source of truth
+			m.setStale(true)
+			errs = append(errs, fmt.Errorf("host %s: %w", m.host, err))
+			continue
+		}
+		m.setWritten(time.Now())
+	}
+
+	if reached == 0 {
+		return fmt.Errorf("cluster: no host reachable: %w", errUnreachable)
+	}
+	return errors.Join(errs...)
+}
+
+// Status checks the credentials against the first reachable host.
+func (c *clusterClient) Status(ctx context.Context) error {
+	return c.first(ctx, func(h *httpClient) error {
+		return h.login(ctx)
+	})
+}
+
+// List retrieves the HostOverrides from the first reachable host.
+func (c *clusterClient) List(ctx context.Context) ([]Record, error) {
+	var overrides []DNSRecord
+	err := c.first(ctx, func(h *httpClient) error {
+		var err error
+		overrides, err = h.GetHostOverrides(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, len(overrides))
+	for _, r := range overrides {
+		records = append(records, r.record())
+	}
+	return records, nil
+}
+
+// Create creates a HostOverride on the cluster, returning the existing record of the first host that had one.
+func (c *clusterClient) Create(ctx context.Context, record Record) (*Record, error) {
+	var existing *Record
+	err := c.write(ctx, func(h *httpClient) error {
+		lookup, err := h.CreateHostOverride(ctx, hostOverride(record))
+		if existing == nil && lookup != nil {
+			r := lookup.record()
+			existing = &r
+		}
+		return err
+	})
+	return existing, err
+}
+
+// Update updates a HostOverride on the cluster.
+func (c *clusterClient) Update(ctx context.Context, old, record Record) error {
+	return c.write(ctx, func(h *httpClient) error {
+		return h.UpdateHostOverride(ctx, old, record)
+	})
+}
+
+// Delete deletes a HostOverride from the cluster.
+func (c *clusterClient) Delete(ctx context.Context, record Record) error {
+	return c.write(ctx, func(h *httpClient) error {
+		return h.DeleteHostOverride(ctx, hostOverride(record))
+	})
+}
+
+// listAliases retrieves the aliases of the HostOverrides from the first reachable host.
+func (c *clusterClient) listAliases(ctx context.Context) ([]Alias, error) {
+	var aliases []Alias
+	err := c.first(ctx, func(h *httpClient) error {
+		var err error
+		aliases, err = h.hostAliases(ctx)
+		return err
+	})
+	return aliases, err
+}
+
+// createAlias adds an alias on the cluster. Every host looks up the HostOverride by name, as uuids differ.
+func (c *clusterClient) createAlias(ctx context.Context, alias Alias) error {
+	return c.write(ctx, func(h *httpClient) error {
+		return h.CreateHostAlias(ctx, alias)
+	})
+}
+
+// Apply reconfigures Unbound on the cluster.
+func (c *clusterClient) Apply(ctx context.Context) error {
+	return c.write(ctx, func(h *httpClient) error {
+		return h.ReconfigureUnbound(ctx)
+	})
+}
+
+// reconcile makes every reachable member hold the same records as the first member
+// that didn't miss any write, limited to the records managed reports true for.
+// If every reachable member missed a write, e.g. after the hosts went down one after
+// the other, the member that took the latest write is reconciled from instead.
+// It is a no-op in failover mode.
+func (c *clusterClient) reconcile(ctx context.Context, managed func(Record) bool) error {
+	if c.mode != HAModeAll || len(c.members) < 2 {
+		return nil
+	}
+
+	members := c.preferred()
+	if members[0].isStale() {
+		latest := slices.MaxFunc(members, func(a, b *member) int {
+			return a.lastWritten().Compare(b.lastWritten())
+		})
+		if latest.lastWritten().IsZero() {
+			return fmt.Errorf("reconcile: every reachable host missed changes and none took a write since, there is no host to reconcile from")
+		}
+		requestid.Log(ctx).Warnf("reconcile: every reachable host missed changes, reconciling from %s which took the latest write", latest.host)
+		i := slices.Index(members, latest)
+		members[0], members[i] = members[i], members[0]
+	}
+	primary := members[0]
+	want, err := primary.GetHostOverrides(ctx)
+	c.observe(primary, err)
+	if err != nil {
+		return fmt.Errorf("reconcile: reading records from %s: %w", primary.host, err)
+	}
+	wanted := indexHostOverrides(want, managed)
+
+	var errs []error
+	for _, m := range members[1:] {
+		if err := c.reconcileMember(ctx, m, wanted, managed); err != nil {
+			errs = append(errs, fmt.Errorf("reconcile: host %s: %w", m.host, err))
+			continue
+		}
+		m.setStale(false)
+	}
+	if len(errs) == 0 {
+		// The other members hold its records now, so whatever it missed is gone everywhere
+		primary.setStale(false)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *clusterClient) reconcileMember(ctx context.Context, m *member, wanted map[string]DNSRecord, managed func(Record) bool) error {
+	have, err := m.GetHostOverrides(ctx)
+	c.observe(m, err)
+	if err != nil {
+		return err
+	}
+	existing := indexHostOverrides(have, managed)
+
+	changed := false
+	for key, record := range existing {
+		if w, ok := wanted[key]; ok && w.Server == record.Server {
+			continue
+		}
+		requestid.Log(ctx).Infof("reconcile: removing %s record %s from %s", PruneUnboundType(record.Rr), JoinUnboundFQDN(record.Hostname, record.Domain), m.host)
+		if err := m.DeleteHostOverride(ctx, record); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	for key, record := range wanted {
+		if e, ok := existing[key]; ok && e.Server == record.Server {
+			continue
+		}
+		requestid.Log(ctx).Infof("reconcile: adding %s record %s to %s", PruneUnboundType(record.Rr), JoinUnboundFQDN(record.Hostname, record.Domain), m.host)
+		if _, err := m.CreateHostOverride(ctx, record); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return m.ReconfigureUnbound(ctx)
+}
+
+// Health returns the last error seen for every member, or the state of its
+// circuit breaker while that isn't closed, keyed by host.
+func (c *clusterClient) Health() map[string]error {
+	health := make(map[string]error, len(c.members))
+	for _, m := range c.members {
+		m.mu.Lock()
+		health[m.host] = m.lastErr
+		m.mu.Unlock()
+
+		if health[m.host] == nil {
+			health[m.host] = m.breaker.status()
+		}
+	}
+	return health
+}
+
+// Close closes the idle connections to every member.
+func (c *clusterClient) Close() {
+	for _, m := range c.members {
+		m.CloseIdleConnections()
+	}
+}
+
+// indexHostOverrides keys the host overrides keep reports true for like indexRecords. A nil keep keeps every record.
+func indexHostOverrides(records []DNSRecord, keep func(Record) bool) map[string]DNSRecord {
+	index := make(map[string]DNSRecord, len(records))
+	for _, r := range records {
+		if keep != nil && !keep(r.record()) {
+			continue
+		}
+		index[r.record().key()] = r
+	}
+	return index
+}
@@ -0,0 +1,114 @@
+package opnsense
+
+import (
+	"context"
+	"testing"
+)
+
+func testRecord(hostname, target string) Record {
+	return Record{Name: hostname + ".example.com", Type: "A", Target: target, Enabled: true, Description: "external-dns"}
+}
+
+func hostnames(records []DNSRecord) []string {
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Hostname)
+	}
+	return names
+}
+
+func TestReconcileFromFreshMember(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newFakeUnbound(t), newFakeUnbound(t)
+	c := newTestCluster(t, HAModeAll, primary, secondary)
+
+	secondary.setDown(true)
+	if _, err := c.Create(ctx, testRecord("nas", "192.168.1.10")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.members[1].isStale() {
+		t.Fatal("the member missing the write isn't stale")
+	}
+
+	secondary.setDown(false)
+	if err := c.reconcile(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := hostnames(secondary.list()); len(got) != 1 || got[0] != "nas" {
+		t.Errorf("secondary holds %v after reconciling, want [nas]", got)
+	}
+	if c.members[1].isStale() {
+		t.Error("the reconciled member is still stale")
+	}
+}
+
+func TestReconcileFromMemberThatTookTheWrite(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newFakeUnbound(t), newFakeUnbound(t)
+	c := newTestCluster(t, HAModeAll, primary, secondary)
+
+	// The primary is reachable but fails the write the secondary takes
+	primary.setFailAdds(true)
+	if _, err := c.Create(ctx, testRecord("nas", "192.168.1.10")); err == nil {
+		t.Fatal("Create succeeded although a host failed the write")
+	}
+	primary.setFailAdds(false)
+	if !c.members[0].isStale() {
+		t.Fatal("the member that failed the write isn't stale")
+	}
+
+	if err := c.reconcile(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range map[string]*fakeUnbound{"primary": primary, "secondary": secondary} {
+		if got := hostnames(f.list()); len(got) != 1 || got[0] != "nas" {
+			t.Errorf("%s holds %v after reconciling, want [nas]", name, got)
+		}
+	}
+}
+
+func TestReconcileWhenEveryMemberIsStale(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newFakeUnbound(t), newFakeUnbound(t)
+	c := newTestCluster(t, HAModeAll, primary, secondary)
+
+	// The hosts go down one after the other, each missing a write the other took
+	primary.setDown(true)
+	if _, err := c.Create(ctx, testRecord("nas", "192.168.1.10")); err != nil {
+		t.Fatal(err)
+	}
+	primary.setDown(false)
+	secondary.setDown(true)
+	if _, err := c.Create(ctx, testRecord("app", "192.168.1.20")); err != nil {
+		t.Fatal(err)
+	}
+	secondary.setDown(false)
+
+	if !c.members[0].isStale() || !c.members[1].isStale() {
+		t.Fatal("both members should have missed a write")
+	}
+
+	// The primary took the latest write, the records the secondary took earlier are lost
+	// just like they would be after a failover, and external-dns creates them again
+	if err := c.reconcile(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := hostnames(secondary.list()); len(got) != 1 || got[0] != "app" {
+		t.Errorf("secondary holds %v after reconciling, want [app]", got)
+	}
+	if c.members[0].isStale() || c.members[1].isStale() {
+		t.Error("the hosts hold the same records but are still stale")
+	}
+}
+
+func TestReconcileWithoutAnyWrite(t *testing.T) {
+	primary, secondary := newFakeUnbound(t), newFakeUnbound(t)
+	c := newTestCluster(t, HAModeAll, primary, secondary)
+	for _, m := range c.members {
+		m.setStale(true)
+	}
+
+	if err := c.reconcile(context.Background(), nil); err == nil {
+		t.Error("reconciling without any host to reconcile from succeeded")
+	}
+}
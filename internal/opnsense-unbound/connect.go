@@ -0,0 +1,101 @@
+package opnsense
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// initialLoginBackoff is the delay before the first login retry, it doubles up to the configured maximum
+const initialLoginBackoff = time.Second
+
+// connection tracks whether the initial login to a target succeeded yet.
+type connection struct {
+	mu        sync.Mutex
+	connected bool
+	err       error
+	// done is closed once connected
+	done chan struct{}
+}
+
+func newConnection() *connection {
+	return &connection{err: fmt.Errorf("not connected yet: %w", errUnreachable), done: make(chan struct{})}
+}
+
+// status returns nil once connected, or the reason the target isn't connected yet.
+func (c *connection) status() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connected {
+		return nil
+	}
+	return c.err
+}
+
+func (c *connection) set(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		if !c.connected {
+			close(c.done)
+		}
+		c.connected = true
+		c.err = nil
+		return
+	}
+	// Keep the error reported as unavailable, whatever the login failed with
+	c.err = fmt.Errorf("not connected yet: %w: %w", errUnreachable, err)
+}
+
+// connect logs in to the target, retrying with exponential backoff until it succeeds or ctx is done.
+func (t *target) connect(ctx context.Context, maxBackoff time.Duration) {
+	backoff := initialLoginBackoff
+	for {
+		err := t.backend.Login(ctx)
+		t.connection.set(err)
+		if err == nil {
+			log.Infof("connect: logged in to opnsense target '%s'", t.name)
+			return
+		}
+
+		log.Warnf("connect: login to opnsense target '%s' failed, retrying in %s: %v", t.name, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connected returns an error for the first target that isn't connected yet.
+func (p *Provider) connected() error {
+	for _, t := range p.targets {
+		if err := t.connection.status(); err != nil {
+			return fmt.Errorf("target '%s': %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// WaitConnected blocks until every target is connected, returning the reason
+// a target isn't connected yet if ctx is done first.
+func (p *Provider) WaitConnected(ctx context.Context) error {
+	for _, t := range p.targets {
+		select {
+		case <-t.connection.done:
+		case <-ctx.Done():
+			return fmt.Errorf("target '%s': %w", t.name, t.connection.status())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package opnsense
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// Kinds of drift between the records the webhook applied and the ones in OPNsense
+const (
+	// DriftMissing is a record the webhook applied that was removed from OPNsense
+	DriftMissing = "missing"
+	// DriftChanged is a record whose address was changed in OPNsense
+	DriftChanged = "changed"
+	// DriftDisabled is a record that was disabled in OPNsense
+	DriftDisabled = "disabled"
+	// DriftUnexpected is a record in a managed domain the webhook didn't apply
+	DriftUnexpected = "unexpected"
+)
+
+// Drift status of a target
+const (
+	DriftStatusInSync  = "in sync"
+	DriftStatusDrifted = "drifted"
+	// DriftStatusUnknown is reported until the webhook read or applied the records of a target
+	DriftStatusUnknown = "unknown"
+	DriftStatusFailed  = "failed"
+)
+
+var driftKinds = []string{DriftMissing, DriftChanged, DriftDisabled, DriftUnexpected}
+
+// DriftReport holds the outcome of the last drift check of every target.
+type DriftReport struct {
+	Enabled   bool          `json:"enabled"`
+	CheckedAt *time.Time    `json:"checkedAt,omitempty"`
+	Targets   []TargetDrift `json:"targets"`
+}
+
+// TargetDrift holds the differences found on a single target.
+type TargetDrift struct {
+	Name        string       `json:"name"`
+	Status      string       `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	Differences []Difference `json:"differences,omitempty"`
+}
+
+// Difference is a single record that differs from what the webhook applied.
+type Difference struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d Difference) String() string {
+	switch d.Kind {
+	case DriftMissing:
+		return fmt.Sprintf("%s %s pointing to %s was removed", d.Type, d.Name, d.Expected)
+	case DriftChanged:
+		return fmt.Sprintf("%s %s was changed from %s to %s", d.Type, d.Name, d.Expected, d.Actual)
+	case DriftDisabled:
+		return fmt.Sprintf("%s %s pointing to %s was disabled", d.Type, d.Name, d.Actual)
+	default:
+		return fmt.Sprintf("%s %s pointing to %s wasn't created by the webhook", d.Type, d.Name, d.Actual)
+	}
+}
+
+// driftState tracks the records the webhook expects on a target, keyed like indexRecords,
+// and the outcome of the last drift check.
+type driftState struct {
+	mu sync.Mutex
+	// expected is nil until the records of the target were first read or applied
+	expected map[string]string
+	// generation changes whenever expected does, so checks racing with changes are discarded
+	generation uint64
+	report     TargetDrift
+}
+
+// baseline sets the expected records from the ones read from OPNsense, unless they are known already.
+func (s *driftState) baseline(records []Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expected != nil {
+		return
+	}
+	s.expected = make(map[string]string, len(records))
+	for key, record := range indexRecords(records, nil) {
+		s.expected[key] = record.Target
+	}
+	s.generation++
+}
+
+// applied updates the expected records with a batch of changes that was applied successfully.
+func (s *driftState) applied(changes *plan.Changes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	if s.expected == nil {
+		// Only the changed records are known, the rest is read by the next Records call
+		return
+	}
+	for _, ep := range append(changes.UpdateOld, changes.Delete...) {
+		delete(s.expected, ep.DNSName+"/"+ep.RecordType)
+	}
+	for _, ep := range append(changes.Create, changes.UpdateNew...) {
+		if len(ep.Targets) > 0 {
+			s.expected[ep.DNSName+"/"+ep.RecordType] = ep.Targets[0]
+		}
+	}
+}
+
+// forget drops the expected records after a failed batch left them unknown.
+func (s *driftState) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expected = nil
+	s.generation++
+}
+
+// snapshot returns a copy of the expected records along with their generation.
+func (s *driftState) snapshot() (map[string]string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expected == nil {
+		return nil, s.generation
+	}
+	expected := make(map[string]string, len(s.expected))
+	for key, server := range s.expected {
+		expected[key] = server
+	}
+	return expected, s.generation
+}
+
+// setReport stores report unless the expected records changed since generation,
+// returning whether it was stored and the previous report.
+func (s *driftState) setReport(report TargetDrift, generation uint64) (TargetDrift, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return s.report, false
+	}
+	previous := s.report
+	s.report = report
+	return previous, true
+}
+
+// inherit takes over the expected records and the last report of previous.
+func (s *driftState) inherit(previous *driftState) {
+	expected, _ := previous.snapshot()
+	report := previous.lastReport()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expected, s.report = expected, report
+	s.generation++
+}
+
+func (s *driftState) lastReport() TargetDrift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+// diffRecords compares the expected records against the live ones.
+func diffRecords(expected map[string]string, live map[string]Record) []Difference {
+	var differences []Difference
+	for key, server := range expected {
+		record, ok := live[key]
+		name, rrType := splitRecordKey(key)
+		switch {
+		case !ok:
+			differences = append(differences, Difference{Kind: DriftMissing, Name: name, Type: rrType, Expected: server})
+		case record.Target != server:
+			differences = append(differences, Difference{Kind: DriftChanged, Name: name, Type: rrType, Expected: server, Actual: record.Target})
+		case !record.Enabled:
+			differences = append(differences, Difference{Kind: DriftDisabled, Name: name, Type: rrType, Expected: server, Actual: record.Target})
+		}
+	}
+	for key, record := range live {
+		if _, ok := expected[key]; !ok {
+			name, rrType := splitRecordKey(key)
+			differences = append(differences, Difference{Kind: DriftUnexpected, Name: name, Type: rrType, Actual: record.Target})
+		}
+	}
+
+	slices.SortFunc(differences, func(a, b Difference) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+	return differences
+}
+
+// splitRecordKey splits a key of indexRecords into the FQDN and the record type.
+func splitRecordKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// watchDrift checks every target for drift each interval until ctx is done.
+func (p *Provider) watchDrift(ctx context.Context, interval time.Duration) {
+	log.Infof("drift: checking the records for drift every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		p.checkDrift(checkCtx)
+		cancel()
+	}
+}
+
+// checkDrift compares the live records of every target against the ones the webhook applied,
+// logging the differences whenever they change.
+func (p *Provider) checkDrift(ctx context.Context) {
+	for _, t := range p.targets {
+		expected, generation := t.drift.snapshot()
+		report := TargetDrift{Name: t.name, Status: DriftStatusUnknown}
+
+		switch err := t.connection.status(); {
+		case expected == nil:
+			// Nothing was read or applied yet, so any record could be drift
+		case err != nil:
+			report.Status, report.Error = DriftStatusFailed, err.Error()
+		default:
+			records, err := t.backend.List(ctx)
+			if err != nil {
+				report.Status, report.Error = DriftStatusFailed, err.Error()
+				break
+			}
+			report.Differences = diffRecords(expected, indexRecords(p.managed(t, records), nil))
+			report.Status = DriftStatusInSync
+			if len(report.Differences) > 0 {
+				report.Status = DriftStatusDrifted
+			}
+		}
+
+		previous, ok := t.drift.setReport(report, generation)
+		if !ok {
+			log.Debugf("drift: records of target '%s' changed during the check, discarding it", t.name)
+			continue
+		}
+		setDriftMetrics(t.name, report)
+
+		switch {
+		case report.Status == DriftStatusFailed && previous.Status != DriftStatusFailed:
+			log.Warnf("drift: checking target '%s' failed: %s", t.name, report.Error)
+		case report.Status == DriftStatusDrifted && !slices.Equal(report.Differences, previous.Differences):
+			for _, d := range report.Differences {
+				log.Warnf("drift: target '%s': %s", t.name, d)
+			}
+		case report.Status == DriftStatusInSync && previous.Status == DriftStatusDrifted:
+			log.Infof("drift: records of target '%s' are in sync again", t.name)
+		}
+	}
+	now := time.Now().UTC()
+	p.driftCheckedAt.Store(&now)
+	lastDriftCheck.SetToCurrentTime()
+}
+
+// Drift returns the outcome of the last drift check of every target.
+func (p *Provider) Drift() DriftReport {
+	report := DriftReport{Enabled: p.driftInterval > 0}
+	for _, t := range p.targets {
+		td := t.drift.lastReport()
+		if td.Name == "" {
+			td = TargetDrift{Name: t.name, Status: DriftStatusUnknown}
+		}
+		report.Targets = append(report.Targets, td)
+	}
+	report.CheckedAt = p.driftCheckedAt.Load()
+	return report
+}
+
+// setDriftMetrics replaces the drift counts of a target with the ones of report.
+func setDriftMetrics(target string, report TargetDrift) {
+	counts := make(map[string]int, len(driftKinds))
+	for _, d := range report.Differences {
+		counts[d.Kind]++
+	}
+	for _, kind := range driftKinds {
+		driftedRecords.WithLabelValues(target, kind).Set(float64(counts[kind]))
+	}
+}
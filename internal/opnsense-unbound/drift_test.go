@@ -0,0 +1,132 @@
+package opnsense
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestDiffRecords(t *testing.T) {
+	disabled := memoryRecord("app.example.com", "192.168.1.20", "")
+	disabled.Enabled = false
+
+	for _, tc := range []struct {
+		name     string
+		expected map[string]string
+		live     []Record
+		want     []Difference
+	}{
+		{
+			name:     "in sync",
+			expected: map[string]string{"nas.example.com/A": "192.168.1.10"},
+			live:     []Record{memoryRecord("nas.example.com", "192.168.1.10", "")},
+		},
+		{
+			name:     "missing",
+			expected: map[string]string{"nas.example.com/A": "192.168.1.10"},
+			want:     []Difference{{Kind: DriftMissing, Name: "nas.example.com", Type: "A", Expected: "192.168.1.10"}},
+		},
+		{
+			name:     "changed",
+			expected: map[string]string{"nas.example.com/A": "192.168.1.10"},
+			live:     []Record{memoryRecord("nas.example.com", "192.168.1.11", "")},
+			want:     []Difference{{Kind: DriftChanged, Name: "nas.example.com", Type: "A", Expected: "192.168.1.10", Actual: "192.168.1.11"}},
+		},
+		{
+			name:     "disabled",
+			expected: map[string]string{"app.example.com/A": "192.168.1.20"},
+			live:     []Record{disabled},
+			want:     []Difference{{Kind: DriftDisabled, Name: "app.example.com", Type: "A", Expected: "192.168.1.20", Actual: "192.168.1.20"}},
+		},
+		{
+			name: "unexpected",
+			live: []Record{memoryRecord("www.example.com", "192.168.1.30", "")},
+			want: []Difference{{Kind: DriftUnexpected, Name: "www.example.com", Type: "A", Actual: "192.168.1.30"}},
+		},
+		{
+			name: "sorted by name",
+			expected: map[string]string{
+				"nas.example.com/A": "192.168.1.10",
+				"app.example.com/A": "192.168.1.20",
+			},
+			live: []Record{memoryRecord("www.example.com", "192.168.1.30", "")},
+			want: []Difference{
+				{Kind: DriftMissing, Name: "app.example.com", Type: "A", Expected: "192.168.1.20"},
+				{Kind: DriftMissing, Name: "nas.example.com", Type: "A", Expected: "192.168.1.10"},
+				{Kind: DriftUnexpected, Name: "www.example.com", Type: "A", Actual: "192.168.1.30"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := diffRecords(tc.expected, indexRecords(tc.live, nil))
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("diffRecords = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetReportDiscardsStaleChecks(t *testing.T) {
+	s := &driftState{}
+	s.baseline([]Record{memoryRecord("nas.example.com", "192.168.1.10", "")})
+	_, generation := s.snapshot()
+
+	// A batch is applied while the check is running
+	s.applied(&plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20")}})
+
+	stale := TargetDrift{Name: DefaultTargetName, Status: DriftStatusDrifted, Differences: []Difference{{Kind: DriftUnexpected, Name: "app.example.com", Type: "A"}}}
+	if _, ok := s.setReport(stale, generation); ok {
+		t.Error("setReport stored a check that raced with a batch")
+	}
+	if got := s.lastReport(); got.Status != "" {
+		t.Errorf("lastReport = %+v, want no report yet", got)
+	}
+
+	expected, generation := s.snapshot()
+	if want := map[string]string{"nas.example.com/A": "192.168.1.10", "app.example.com/A": "192.168.1.20"}; !maps.Equal(expected, want) {
+		t.Errorf("expected records = %v, want %v", expected, want)
+	}
+	current := TargetDrift{Name: DefaultTargetName, Status: DriftStatusInSync}
+	if _, ok := s.setReport(current, generation); !ok {
+		t.Error("setReport discarded a check of the current records")
+	}
+	if got := s.lastReport(); got.Status != DriftStatusInSync {
+		t.Errorf("lastReport = %+v, want in sync", got)
+	}
+}
+
+func TestCheckDriftReportsChangesMadeInOPNsense(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+		memoryRecord("app.example.com", "192.168.1.20", ""),
+	)
+	p := newTestProvider(t, nil, ProviderConfig{}, target)
+	ctx := context.Background()
+
+	p.checkDrift(ctx)
+	if got := p.Drift().Targets[0].Status; got != DriftStatusUnknown {
+		t.Errorf("drift status = %s before the records were read, want %s", got, DriftStatusUnknown)
+	}
+
+	if _, err := p.Records(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.checkDrift(ctx)
+	if got := p.Drift().Targets[0].Status; got != DriftStatusInSync {
+		t.Errorf("drift status = %s, want %s", got, DriftStatusInSync)
+	}
+
+	if err := backend.Delete(ctx, memoryRecord("app.example.com", "", "")); err != nil {
+		t.Fatal(err)
+	}
+	p.checkDrift(ctx)
+	report := p.Drift().Targets[0]
+	want := []Difference{{Kind: DriftMissing, Name: "app.example.com", Type: "A", Expected: "192.168.1.20"}}
+	if report.Status != DriftStatusDrifted || !slices.Equal(report.Differences, want) {
+		t.Errorf("drift report = %+v, want the removed record", report)
+	}
+}
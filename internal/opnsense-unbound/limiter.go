@@ -0,0 +1,72 @@
+package opnsense
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// requestLimiter throttles the requests sent to a single firewall, both in rate and in concurrency.
+type requestLimiter struct {
+	host    string
+	limiter *rate.Limiter
+	slots   chan struct{}
+}
+
+// newRequestLimiter creates a limiter allowing requestsPerSecond with the given burst
+// and at most maxConcurrent requests in flight. Zero values disable the respective limit.
+func newRequestLimiter(host string, requestsPerSecond float64, burst, maxConcurrent int) *requestLimiter {
+	l := &requestLimiter{host: host}
+	if requestsPerSecond > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// acquire blocks until a request may be sent and returns the function releasing its slot.
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+	defer func() {
+		rateLimitWait.WithLabelValues(l.host).Observe(time.Since(start).Seconds())
+	}()
+
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-l.slots }) }
+	}
+
+	if l.limiter != nil {
+		if err := l.limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	return release, nil
+}
+
+// releasingBody releases a request slot once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
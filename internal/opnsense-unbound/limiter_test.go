@@ -0,0 +1,75 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestLimiterThrottlesBursts(t *testing.T) {
+	l := newRequestLimiter("throttle.example.com", 20, 2, 0)
+	ctx := context.Background()
+
+	start := time.Now()
+	for range 4 {
+		release, err := l.acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// The burst of 2 passes at once, the other 2 requests wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("4 requests took %s, want at least 100ms with a burst of 2 at 20 per second", elapsed)
+	}
+}
+
+func TestRequestLimiterLimitsConcurrency(t *testing.T) {
+	l := newRequestLimiter("concurrency.example.com", 0, 0, 1)
+
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire = %v with every slot taken, want the deadline to abort the wait", err)
+	}
+
+	// Releasing twice must not free a slot taken by someone else
+	release()
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err == nil {
+		t.Error("a second release freed another slot")
+	}
+}
+
+func TestRequestLimiterCancelledWait(t *testing.T) {
+	l := newRequestLimiter("cancel.example.com", 0.1, 1, 0)
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx)
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("acquire succeeded after the context was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire kept waiting after the context was cancelled")
+	}
+}
@@ -0,0 +1,173 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// Reasons a batch of changes is blocked, as reported in metrics
+const (
+	blockedMaxDeletes       = "max_deletes"
+	blockedMaxDeletePercent = "max_delete_percent"
+	blockedDeleteAll        = "delete_all"
+)
+
+type deleteLimitsOverrideKey struct{}
+
+// WithDeleteLimitsOverride returns a context that makes ApplyChanges skip the deletion safety limits.
+func WithDeleteLimitsOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deleteLimitsOverrideKey{}, true)
+}
+
+func deleteLimitsOverridden(ctx context.Context) bool {
+	override, _ := ctx.Value(deleteLimitsOverrideKey{}).(bool)
+	return override
+}
+
+// deleteLimits guards against batches deleting more records than a sane plan would.
+type deleteLimits struct {
+	max            int
+	maxPercent     float64
+	allowDeleteAll bool
+	// deleteAllMin is how many records a target has to manage before deleting all of them is refused
+	deleteAllMin int
+	// overrideFile lets a single blocked batch through while it exists, it is removed afterwards
+	overrideFile string
+}
+
+func (l deleteLimits) enabled() bool {
+	return l.max > 0 || l.maxPercent > 0 || !l.allowDeleteAll
+}
+
+// netDeletes returns the deletes of changes that aren't offset by a create of the same name and type,
+// e.g. when external-dns replaces a record instead of updating it.
+func netDeletes(changes *plan.Changes) []*endpoint.Endpoint {
+	created := make(map[string]bool, len(changes.Create))
+	for _, ep := range changes.Create {
+		created[ep.DNSName+" "+ep.RecordType] = true
+	}
+
+	var deletes []*endpoint.Endpoint
+	for _, ep := range changes.Delete {
+		if !created[ep.DNSName+" "+ep.RecordType] {
+			deletes = append(deletes, ep)
+		}
+	}
+	return deletes
+}
+
+// checkDeleteLimits refuses a batch whose deletes exceed the limits, logging every delete it would have made.
+// Deletes are counted per target against the records it manages. Updates and deletes offset by a create
+// of the same name and type don't count.
+func (p *Provider) checkDeleteLimits(ctx context.Context, routed map[*target]*plan.Changes) error {
+	deletes := make(map[*target][]*endpoint.Endpoint, len(routed))
+	total := 0
+	for t, tc := range routed {
+		deletes[t] = netDeletes(tc)
+		total += len(deletes[t])
+	}
+	if total == 0 || !p.deleteLimits.enabled() {
+		return nil
+	}
+
+	var reasons []string
+	var metricReasons []string
+	if p.deleteLimits.max > 0 && total > p.deleteLimits.max {
+		reasons = append(reasons, fmt.Sprintf("%d deletes exceed the maximum of %d", total, p.deleteLimits.max))
+		metricReasons = append(metricReasons, blockedMaxDeletes)
+	}
+
+	for _, t := range p.targets {
+		deleted := len(deletes[t])
+		if deleted == 0 {
+			continue
+		}
+		if p.deleteLimits.maxPercent <= 0 && p.deleteLimits.allowDeleteAll {
+			continue
+		}
+
+		managed, err := p.managedCount(ctx, t)
+		if err != nil {
+			return unavailable(fmt.Errorf("apply: target '%s': %w", t.name, err))
+		}
+		if managed == 0 {
+			continue
+		}
+
+		percent := float64(deleted) * 100 / float64(managed)
+		if !p.deleteLimits.allowDeleteAll && managed >= p.deleteLimits.deleteAllMin && deleted >= managed {
+			reasons = append(reasons, fmt.Sprintf("target '%s': the batch deletes all %d managed records", t.name, managed))
+			metricReasons = append(metricReasons, blockedDeleteAll)
+		} else if p.deleteLimits.maxPercent > 0 && percent > p.deleteLimits.maxPercent {
+			reasons = append(reasons, fmt.Sprintf("target '%s': %d deletes are %.1f%% of the %d managed records, exceeding the maximum of %g%%",
+				t.name, deleted, percent, managed, p.deleteLimits.maxPercent))
+			metricReasons = append(metricReasons, blockedMaxDeletePercent)
+		}
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	if deleteLimitsOverridden(ctx) {
+		requestid.Log(ctx).Warnf("apply: deletion safety limits overridden, applying the batch although %s", strings.Join(reasons, ", "))
+		return nil
+	}
+	if p.deleteLimits.overrideFile != "" {
+		err := os.Remove(p.deleteLimits.overrideFile)
+		if err == nil {
+			requestid.Log(ctx).Warnf("apply: deletion safety limits overridden by %s, applying the batch although %s", p.deleteLimits.overrideFile, strings.Join(reasons, ", "))
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			requestid.Log(ctx).Errorf("apply: removing the override file %s failed, keeping the batch blocked: %v", p.deleteLimits.overrideFile, err)
+		}
+	}
+
+	for _, reason := range metricReasons {
+		blockedBatches.WithLabelValues(reason).Inc()
+	}
+	blockedDeletes.Set(float64(total))
+
+	requestid.Log(ctx).Errorf("apply: blocked a batch of %d creates, %d updates and %d deletes: %s",
+		countChanges(routed, func(c *plan.Changes) int { return len(c.Create) }),
+		countChanges(routed, func(c *plan.Changes) int { return len(c.UpdateNew) }),
+		total, strings.Join(reasons, ", "))
+	for _, t := range p.targets {
+		for _, ep := range deletes[t] {
+			requestid.Log(ctx).Errorf("apply: blocked delete of %s %s pointing to %s on target '%s'", ep.RecordType, ep.DNSName, strings.Join(ep.Targets, ","), t.name)
+		}
+	}
+
+	return refusedError{fmt.Errorf("apply: refusing to apply the batch, %s", strings.Join(reasons, ", "))}
+}
+
+// managedCount returns the number of records target t manages. The count of the last Records call is
+// reused, external-dns reads the records before every batch, the records are only read again if
+// changes were applied since, e.g. on the command line.
+func (p *Provider) managedCount(ctx context.Context, t *target) (int, error) {
+	if n := t.managedCount.Load(); n >= 0 {
+		return int(n), nil
+	}
+
+	records, err := t.backend.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(p.managed(t, records)), nil
+}
+
+func countChanges(routed map[*target]*plan.Changes, count func(*plan.Changes) int) int {
+	n := 0
+	for _, tc := range routed {
+		n += count(tc)
+	}
+	return n
+}
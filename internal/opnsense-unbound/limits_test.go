@@ -0,0 +1,231 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestNetDeletes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		changes *plan.Changes
+		want    []string
+	}{
+		{
+			name:    "no deletes",
+			changes: &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")}},
+		},
+		{
+			name: "plain deletes",
+			changes: &plan.Changes{Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10"),
+				endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20"),
+			}},
+			want: []string{"nas.example.com A", "app.example.com A"},
+		},
+		{
+			name: "replaced record",
+			changes: &plan.Changes{
+				Create: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.11")},
+				Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")},
+			},
+		},
+		{
+			name: "create of another type",
+			changes: &plan.Changes{
+				Create: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "AAAA", "fd00::10")},
+				Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")},
+			},
+			want: []string{"nas.example.com A"},
+		},
+		{
+			name: "updates don't offset deletes",
+			changes: &plan.Changes{
+				UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")},
+				UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.11")},
+				Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")},
+			},
+			want: []string{"nas.example.com A"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, ep := range netDeletes(tc.changes) {
+				got = append(got, ep.DNSName+" "+ep.RecordType)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("netDeletes = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// limitRecords returns n records named host0.example.com, host1.example.com, ...
+func limitRecords(n int) []Record {
+	var records []Record
+	for i := range n {
+		records = append(records, memoryRecord(fmt.Sprintf("host%d.example.com", i), fmt.Sprintf("192.168.1.%d", i), ""))
+	}
+	return records
+}
+
+// limitDeletes deletes the first n records of limitRecords.
+func limitDeletes(n int) []*endpoint.Endpoint {
+	var deletes []*endpoint.Endpoint
+	for i := range n {
+		deletes = append(deletes, endpoint.NewEndpoint(fmt.Sprintf("host%d.example.com", i), "A", fmt.Sprintf("192.168.1.%d", i)))
+	}
+	return deletes
+}
+
+func TestCheckDeleteLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  ProviderConfig
+		managed int
+		changes *plan.Changes
+		blocked bool
+	}{
+		{
+			name:    "no limits",
+			config:  ProviderConfig{AllowDeleteAll: true},
+			managed: 3,
+			changes: &plan.Changes{Delete: limitDeletes(3)},
+		},
+		{
+			name:    "within the maximum",
+			config:  ProviderConfig{MaxDeletes: 2, AllowDeleteAll: true},
+			managed: 5,
+			changes: &plan.Changes{Delete: limitDeletes(2)},
+		},
+		{
+			name:    "beyond the maximum",
+			config:  ProviderConfig{MaxDeletes: 2, AllowDeleteAll: true},
+			managed: 5,
+			changes: &plan.Changes{Delete: limitDeletes(3)},
+			blocked: true,
+		},
+		{
+			name:    "within the percentage",
+			config:  ProviderConfig{MaxDeletePercent: 50, AllowDeleteAll: true},
+			managed: 4,
+			changes: &plan.Changes{Delete: limitDeletes(2)},
+		},
+		{
+			name:    "beyond the percentage",
+			config:  ProviderConfig{MaxDeletePercent: 50, AllowDeleteAll: true},
+			managed: 4,
+			changes: &plan.Changes{Delete: limitDeletes(3)},
+			blocked: true,
+		},
+		{
+			name:    "delete all",
+			config:  ProviderConfig{DeleteAllMinRecords: 3},
+			managed: 3,
+			changes: &plan.Changes{Delete: limitDeletes(3)},
+			blocked: true,
+		},
+		{
+			name:    "delete all of a small target",
+			config:  ProviderConfig{DeleteAllMinRecords: 3},
+			managed: 2,
+			changes: &plan.Changes{Delete: limitDeletes(2)},
+		},
+		{
+			name:    "delete all but one",
+			config:  ProviderConfig{DeleteAllMinRecords: 3},
+			managed: 3,
+			changes: &plan.Changes{Delete: limitDeletes(2)},
+		},
+		{
+			name:    "replacing every record",
+			config:  ProviderConfig{MaxDeletes: 1, DeleteAllMinRecords: 1},
+			managed: 2,
+			changes: &plan.Changes{
+				Create: []*endpoint.Endpoint{
+					endpoint.NewEndpoint("host0.example.com", "A", "192.168.2.0"),
+					endpoint.NewEndpoint("host1.example.com", "A", "192.168.2.1"),
+				},
+				Delete: limitDeletes(2),
+			},
+		},
+		{
+			name:    "updates",
+			config:  ProviderConfig{MaxDeletes: 1, DeleteAllMinRecords: 1},
+			managed: 2,
+			changes: &plan.Changes{UpdateOld: limitDeletes(2), UpdateNew: limitDeletes(2)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target, _ := memoryTarget(limitRecords(tc.managed)...)
+			p := newTestProvider(t, nil, tc.config, target)
+			ctx := context.Background()
+
+			err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, tc.changes))
+			if blocked := err != nil; blocked != tc.blocked {
+				t.Errorf("checkDeleteLimits = %v, want blocked %v", err, tc.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckDeleteLimitsOverride(t *testing.T) {
+	changes := &plan.Changes{Delete: limitDeletes(3)}
+
+	t.Run("context", func(t *testing.T) {
+		target, _ := memoryTarget(limitRecords(3)...)
+		p := newTestProvider(t, nil, ProviderConfig{MaxDeletes: 1}, target)
+		ctx := WithDeleteLimitsOverride(context.Background())
+
+		if err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, changes)); err != nil {
+			t.Errorf("checkDeleteLimits = %v with the override, want nil", err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		override := filepath.Join(t.TempDir(), "override")
+		if err := os.WriteFile(override, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		target, _ := memoryTarget(limitRecords(3)...)
+		p := newTestProvider(t, nil, ProviderConfig{MaxDeletes: 1, DeleteOverrideFile: override}, target)
+		ctx := context.Background()
+
+		if err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, changes)); err != nil {
+			t.Errorf("checkDeleteLimits = %v with the override file, want nil", err)
+		}
+		if _, err := os.Stat(override); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("the override file wasn't removed: %v", err)
+		}
+		if err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, changes)); err == nil {
+			t.Error("the override file let a second batch through")
+		}
+	})
+}
+
+func TestCheckDeleteLimitsReusesTheCountOfRecords(t *testing.T) {
+	target, backend := memoryTarget(limitRecords(3)...)
+	p := newTestProvider(t, nil, ProviderConfig{DeleteAllMinRecords: 3}, target)
+	ctx := context.Background()
+
+	if _, err := p.Records(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records read by Records are counted, so a failing List doesn't block the batch
+	backend.SetError(errors.New("list failed"))
+	if err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, &plan.Changes{Delete: limitDeletes(3)})); err == nil || errors.Is(err, backend.err) {
+		t.Errorf("checkDeleteLimits = %v, want the batch refused without listing the records", err)
+	}
+	if err := p.checkDeleteLimits(ctx, p.routeChanges(ctx, &plan.Changes{Delete: limitDeletes(1)})); err != nil {
+		t.Errorf("checkDeleteLimits = %v, want nil", err)
+	}
+}
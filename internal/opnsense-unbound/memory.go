@@ -0,0 +1,199 @@
+package opnsense
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// memoryHost is the host the MemoryBackend reports its health for
+const memoryHost = "memory"
+
+var (
+	_ Backend = (*MemoryBackend)(nil)
+	_ aliaser = (*MemoryBackend)(nil)
+)
+
+// MemoryBackend keeps records in memory, e.g. to exercise the provider without a firewall.
+// Like in Unbound, changes are listed right away and Apply only counts the batches.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	records []Record
+	aliases []Alias
+	nextID  int
+	applied int
+	err     error
+}
+
+// NewMemoryBackend creates a MemoryBackend holding records, which get an id if they have none.
+func NewMemoryBackend(records ...Record) *MemoryBackend {
+	b := &MemoryBackend{}
+	for _, record := range records {
+		if record.ID == "" {
+			record.ID = b.newID()
+		}
+		b.records = append(b.records, record)
+	}
+	return b
+}
+
+func (b *MemoryBackend) newID() string {
+	b.nextID++
+	return fmt.Sprintf("memory-%d", b.nextID)
+}
+
+// Records returns a copy of the records held.
+func (b *MemoryBackend) Records() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.records)
+}
+
+// Aliases returns a copy of the aliases held.
+func (b *MemoryBackend) Aliases() []Alias {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.aliases)
+}
+
+// Applied returns how often Apply was called.
+func (b *MemoryBackend) Applied() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.applied
+}
+
+// SetError makes every call fail with err until it is reset with nil.
+func (b *MemoryBackend) SetError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// Login fails with the error set by SetError, if any.
+func (b *MemoryBackend) Login(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Status fails with the error set by SetError, if any.
+func (b *MemoryBackend) Status(ctx context.Context) error {
+	return b.Login(ctx)
+}
+
+// List returns a copy of the records held.
+func (b *MemoryBackend) List(ctx context.Context) ([]Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	return slices.Clone(b.records), nil
+}
+
+// Create adds record with a new id, unless one with the same name and type is held already.
+func (b *MemoryBackend) Create(ctx context.Context, record Record) (*Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if i := b.find(Record{Name: record.Name, Type: record.Type}); i != -1 {
+		existing := b.records[i]
+		return &existing, nil
+	}
+	record.ID = b.newID()
+	b.records = append(b.records, record)
+	return nil, nil
+}
+
+// Update replaces the record matching old with record, adding the words of its description to the existing one.
+func (b *MemoryBackend) Update(ctx context.Context, old, record Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
+	i := b.find(old)
+	if i == -1 {
+		return fmt.Errorf("no %s record %s pointing to %s: %w", old.Type, old.Name, old.Target, errRecordNotFound)
+	}
+	record.ID = b.records[i].ID
+	record.Description = mergeDescription(b.records[i].Description, record.Description)
+	b.records[i] = record
+	return nil
+}
+
+// Delete removes the record with the name and type of record carrying every word of its description.
+func (b *MemoryBackend) Delete(ctx context.Context, record Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
+	record.Target = ""
+	if i := b.find(record); i != -1 {
+		b.records = slices.Delete(b.records, i, i+1)
+	}
+	return nil
+}
+
+// listAliases returns a copy of the aliases held.
+func (b *MemoryBackend) listAliases(ctx context.Context) ([]Alias, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	return slices.Clone(b.aliases), nil
+}
+
+// createAlias adds alias, unless it is held already. The record it belongs to has to be held.
+func (b *MemoryBackend) createAlias(ctx context.Context, alias Alias) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+
+	if b.find(Record{Name: alias.Record, Type: alias.RecordType}) == -1 {
+		return fmt.Errorf("alias %s: no %s record %s: %w", alias.Name, alias.RecordType, alias.Record, errRecordNotFound)
+	}
+	if !slices.ContainsFunc(b.aliases, func(a Alias) bool { return a.key() == alias.key() }) {
+		b.aliases = append(b.aliases, alias)
+	}
+	return nil
+}
+
+// Apply counts the batch.
+func (b *MemoryBackend) Apply(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.applied++
+	return nil
+}
+
+// Health reports the error set by SetError for a single host.
+func (b *MemoryBackend) Health() map[string]error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]error{memoryHost: b.err}
+}
+
+// Close does nothing.
+func (b *MemoryBackend) Close() {}
+
+// find returns the index of the first record matching old, see Record.matches, or -1.
+func (b *MemoryBackend) find(old Record) int {
+	return slices.IndexFunc(b.records, func(r Record) bool {
+		return r.matches(old)
+	})
+}
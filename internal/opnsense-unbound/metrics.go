@@ -0,0 +1,130 @@
+package opnsense
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const metricsNamespace = "opnsense_webhook"
+
+// Results of an OPNsense API request as reported in metrics
+const (
+	apiResultSuccess     = "success"
+	apiResultHTTPError   = "http_error"
+	apiResultUnreachable = "unreachable"
+	apiResultAborted     = "aborted"
+	// apiResultRejected is used for requests never sent because of the circuit breaker or rate limiter
+	apiResultRejected = "rejected"
+)
+
+var (
+	hostUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_up",
+		Help:      "Whether the OPNsense host could be reached on the last request (1) or not (0).",
+	}, []string{"host"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_cache_requests_total",
+		Help:      "Lookups of the record cache by result (hit or miss).",
+	}, []string{"result"})
+
+	rateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time requests to an OPNsense host waited for the rate and concurrency limits.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"host"})
+
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker of an OPNsense host (0 closed, 1 half-open, 2 open).",
+	}, []string{"host"})
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Requests to the OPNsense API by host, path and result.",
+	}, []string{"host", "path", "result"})
+
+	apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of requests to the OPNsense API by host and path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "path"})
+
+	managedRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_records",
+		Help:      "Records managed by the webhook by record type and domain, as of the last read from OPNsense.",
+	}, []string{"type", "domain"})
+
+	lastApplySuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_apply_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successfully applied batch of changes.",
+	})
+
+	blockedBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_batches_total",
+		Help:      "Batches of changes refused by the deletion safety limits by reason (max_deletes, max_delete_percent or delete_all).",
+	}, []string{"reason"})
+
+	blockedDeletes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_deletes",
+		Help:      "Deletes of the last batch refused by the deletion safety limits, reset once a batch is applied.",
+	})
+
+	driftedRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "drifted_records",
+		Help:      "Records that differ from what the webhook applied by target and kind (missing, changed, disabled or unexpected), as of the last drift check.",
+	}, []string{"target", "kind"})
+
+	lastDriftCheck = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_drift_check_timestamp_seconds",
+		Help:      "Unix timestamp of the last drift check.",
+	})
+)
+
+// observeAPIRequest records a request to the OPNsense API. Requests that were
+// never sent are passed with a zero duration and only counted.
+func observeAPIRequest(host, path, result string, duration time.Duration) {
+	path = apiPathLabel(path)
+	apiRequests.WithLabelValues(host, path, result).Inc()
+	if duration > 0 {
+		apiRequestDuration.WithLabelValues(host, path).Observe(duration.Seconds())
+	}
+}
+
+// apiPathLabel strips record identifiers from an API path, e.g. settings/delHostOverride/<uuid>,
+// to keep the cardinality of the path label bounded.
+func apiPathLabel(path string) string {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 3 {
+		return path
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// setManagedRecords replaces the managed record counts with the ones of endpoints.
+func setManagedRecords(endpoints []*endpoint.Endpoint) {
+	managedRecords.Reset()
+	for _, ep := range endpoints {
+		domain := ep.DNSName
+		if split := SplitUnboundFQDN(ep.DNSName); len(split) == 2 {
+			domain = split[1]
+		}
+		managedRecords.WithLabelValues(ep.RecordType, domain).Inc()
+	}
+}
@@ -0,0 +1,31 @@
+package opnsense
+
+import (
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// summarize describes the changes applied to every target for notifications, in the order of the targets.
+func (p *Provider) summarize(routed map[*target]*plan.Changes) notify.Summary {
+	var summary notify.Summary
+	for _, t := range p.targets {
+		tc, ok := routed[t]
+		if !ok {
+			continue
+		}
+		for _, ep := range tc.Create {
+			summary.Creates = append(summary.Creates, notify.Record{Target: t.name, Name: ep.DNSName, Type: ep.RecordType, Targets: ep.Targets})
+		}
+		for i, ep := range tc.UpdateNew {
+			update := notify.Update{Target: t.name, Name: ep.DNSName, Type: ep.RecordType, NewTargets: ep.Targets}
+			if i < len(tc.UpdateOld) {
+				update.OldTargets = tc.UpdateOld[i].Targets
+			}
+			summary.Updates = append(summary.Updates, update)
+		}
+		for _, ep := range tc.Delete {
+			summary.Deletes = append(summary.Deletes, notify.Record{Target: t.name, Name: ep.DNSName, Type: ep.RecordType, Targets: ep.Targets})
+		}
+	}
+	return summary
+}
@@ -0,0 +1,169 @@
+package opnsense
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+const (
+	// ProtectedActionSkip drops changes to protected records from a batch with a warning
+	ProtectedActionSkip = "skip"
+	// ProtectedActionError fails a batch that changes protected records
+	ProtectedActionError = "error"
+)
+
+// protectedPattern matches names, addresses or uuids exactly, as a glob or as a /regular expression/.
+// Every kind of pattern ignores case and a trailing dot.
+type protectedPattern struct {
+	raw   string
+	regex *regexp.Regexp
+	glob  bool
+}
+
+func newProtectedPattern(raw string) (protectedPattern, error) {
+	p := protectedPattern{raw: strings.ToLower(strings.TrimSuffix(raw, "."))}
+	// A regular expression cut in two would silently protect nothing
+	if strings.HasPrefix(raw, "/") != (len(raw) > 1 && strings.HasSuffix(raw, "/")) {
+		return p, fmt.Errorf("protected record '%s': a regular expression has to start and end with a slash", raw)
+	}
+	switch {
+	case len(raw) > 2 && strings.HasPrefix(raw, "/") && strings.HasSuffix(raw, "/"):
+		re, err := regexp.Compile("(?i)" + raw[1:len(raw)-1])
+		if err != nil {
+			return p, fmt.Errorf("protected record '%s': %w", raw, err)
+		}
+		p.regex = re
+	case strings.ContainsAny(raw, "*?["):
+		if _, err := path.Match(p.raw, ""); err != nil {
+			return p, fmt.Errorf("protected record '%s': %w", raw, err)
+		}
+		p.glob = true
+	}
+	return p, nil
+}
+
+func (p protectedPattern) matches(value string) bool {
+	value = strings.ToLower(strings.TrimSuffix(value, "."))
+	if p.regex != nil {
+		return p.regex.MatchString(value)
+	}
+	if p.glob {
+		ok, _ := path.Match(p.raw, value)
+		return ok
+	}
+	return p.raw == value
+}
+
+// protection holds the records the webhook must never change.
+type protection struct {
+	patterns []protectedPattern
+	action   string
+}
+
+func newProtection(config *ProviderConfig) (*protection, error) {
+	p := &protection{action: config.ProtectedAction}
+	for _, raw := range config.ProtectedRecords {
+		if raw == "" {
+			continue
+		}
+		pattern, err := newProtectedPattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p, nil
+}
+
+func (p *protection) matchesAny(values ...string) bool {
+	for _, pattern := range p.patterns {
+		for _, value := range values {
+			if value != "" && pattern.matches(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// record reports whether a record read from OPNsense is protected by its name, address or uuid.
+func (p *protection) record(record Record) bool {
+	return p.matchesAny(record.Name, record.Target, record.ID)
+}
+
+// endpoint reports whether ep is protected by its name, or because a protected record
+// with the same name and type exists on the target. Its targets aren't matched, a record
+// merely pointing to a protected address, e.g. a CNAME to the router, isn't protected itself.
+func (p *protection) endpoint(ep *endpoint.Endpoint, live map[string]bool) bool {
+	return live[ep.DNSName+"/"+ep.RecordType] || p.matchesAny(ep.DNSName)
+}
+
+// protectChanges drops the changes touching protected records, or fails if the
+// protected action is error. Protected uuids are looked up in the live records.
+func (p *Provider) protectChanges(ctx context.Context, routed map[*target]*plan.Changes) error {
+	if len(p.protection.patterns) == 0 {
+		return nil
+	}
+
+	var refused []string
+	for t, tc := range routed {
+		records, err := t.backend.List(ctx)
+		if err != nil {
+			return unavailable(fmt.Errorf("apply: target '%s': %w", t.name, err))
+		}
+		live := make(map[string]bool)
+		for _, record := range records {
+			if p.protection.record(record) {
+				live[record.key()] = true
+			}
+		}
+
+		keep := func(ep *endpoint.Endpoint, action string) bool {
+			if !p.protection.endpoint(ep, live) {
+				return true
+			}
+			refused = append(refused, fmt.Sprintf("%s %s %s on target '%s'", action, ep.RecordType, ep.DNSName, t.name))
+			return false
+		}
+
+		protected := &plan.Changes{}
+		for _, ep := range tc.Create {
+			if keep(ep, "create") {
+				protected.Create = append(protected.Create, ep)
+			}
+		}
+		// UpdateOld and UpdateNew are pairs, keep or drop both so a skipped update doesn't turn into a delete
+		for i, ep := range tc.UpdateNew {
+			if i < len(tc.UpdateOld) && keep(tc.UpdateOld[i], "update") && keep(ep, "update") {
+				protected.UpdateOld = append(protected.UpdateOld, tc.UpdateOld[i])
+				protected.UpdateNew = append(protected.UpdateNew, ep)
+			}
+		}
+		for _, ep := range tc.Delete {
+			if keep(ep, "delete") {
+				protected.Delete = append(protected.Delete, ep)
+			}
+		}
+		*tc = *protected
+	}
+
+	if len(refused) == 0 {
+		return nil
+	}
+	slices.Sort(refused)
+	if p.protection.action == ProtectedActionError {
+		return refusedError{fmt.Errorf("apply: refusing to change protected records: %s", strings.Join(refused, ", "))}
+	}
+	for _, r := range refused {
+		requestid.Log(ctx).Warnf("apply: skipping protected record: %s", r)
+	}
+	return nil
+}
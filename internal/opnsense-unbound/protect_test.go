@@ -0,0 +1,73 @@
+package opnsense
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestNewProtectionKeepsRegexIntact(t *testing.T) {
+	config := &ProviderConfig{
+		ProtectedRecords: []string{`/^nas[0-9]{1,3}\.example\.com$/`, "router.example.com", "*.mgmt.example.com"},
+		ProtectedAction:  ProtectedActionSkip,
+	}
+	p, err := newProtection(config)
+	if err != nil {
+		t.Fatalf("newProtection: %v", err)
+	}
+	if len(p.patterns) != 3 {
+		t.Fatalf("got %d patterns, want 3", len(p.patterns))
+	}
+
+	for name, want := range map[string]bool{
+		"nas12.example.com":    true,
+		"nas1234.example.com":  false,
+		"router.example.com.":  true,
+		"ROUTER.example.com":   true,
+		"sw1.mgmt.example.com": true,
+		"www.example.com":      false,
+		// Regular expressions ignore case and the trailing dot like globs
+		"NAS12.Example.com":    true,
+		"nas12.example.com.":   true,
+		"SW1.mgmt.example.com": true,
+	} {
+		if got := p.matchesAny(name); got != want {
+			t.Errorf("matchesAny(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestNewProtectedPatternRejectsUnbalancedSlashes(t *testing.T) {
+	for _, raw := range []string{`/^nas[0-9]{1`, `3}\.example\.com$/`, "/"} {
+		_, err := newProtectedPattern(raw)
+		if err == nil || !strings.Contains(err.Error(), "start and end with a slash") {
+			t.Errorf("newProtectedPattern(%q) = %v, want an unbalanced slash error", raw, err)
+		}
+	}
+}
+
+func TestProtectionEndpointMatchesNamesOnly(t *testing.T) {
+	p, err := newProtection(&ProviderConfig{ProtectedRecords: []string{"router.example.com", "192.168.1.1"}})
+	if err != nil {
+		t.Fatalf("newProtection: %v", err)
+	}
+	live := map[string]bool{"gateway.example.com/A": true}
+
+	for _, tc := range []struct {
+		ep   *endpoint.Endpoint
+		want bool
+	}{
+		{ep: endpoint.NewEndpoint("router.example.com", "A", "192.168.1.2"), want: true},
+		// A protected record of the same name and type exists, e.g. protected by its address
+		{ep: endpoint.NewEndpoint("gateway.example.com", "A", "192.168.1.3"), want: true},
+		{ep: endpoint.NewEndpoint("gateway.example.com", "AAAA", "fd00::1"), want: false},
+		// Pointing to a protected address doesn't protect a record
+		{ep: endpoint.NewEndpoint("app.example.com", "A", "192.168.1.1"), want: false},
+		{ep: endpoint.NewEndpoint("www.example.com", "CNAME", "router.example.com"), want: false},
+	} {
+		if got := p.endpoint(tc.ep, live); got != tc.want {
+			t.Errorf("endpoint(%s %s -> %v) = %v, want %v", tc.ep.RecordType, tc.ep.DNSName, tc.ep.Targets, got, tc.want)
+		}
+	}
+}
@@ -2,87 +2,494 @@ package opnsense
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 	"sigs.k8s.io/external-dns/provider"
 )
 
+// DefaultTargetName is the name of the target when only a single firewall (or cluster) is configured
+const DefaultTargetName = "default"
+
+// Target is a named OPNsense firewall (or cluster) responsible for the domains matched by its filter.
+// Its records are kept in Unbound as configured by Config, unless a Backend is given.
+type Target struct {
+	Name         string
+	DomainFilter endpoint.DomainFilter
+	Config       *Config
+	Backend      Backend
+}
+
+// target is the runtime counterpart of a Target
+type target struct {
+	name         string
+	backend      Backend
+	domainFilter endpoint.DomainFilter
+	status       *statusCheck
+	connection   *connection
+	drift        *driftState
+	// managedCount is the number of records the target managed when Records last read them,
+	// or -1 if that's unknown, e.g. because changes were applied since
+	managedCount atomic.Int64
+}
+
 // Provider type for interfacing with Opnsense
 type Provider struct {
 	provider.BaseProvider
 
-	client       *httpClient
+	targets      []*target
 	domainFilter endpoint.DomainFilter
+	// endpointFilter selects the endpoints that may be created or updated, by their labels and provider specific properties
+	endpointFilter labels.Selector
+	// marker is the ownership marker, records without it aren't managed if set
+	marker       string
+	protection   *protection
+	deleteLimits deleteLimits
+	audit        *auditLog
+	notifier     *notify.Notifier
+	// changing is held for reading while records are changed, so Close can wait for the changes in flight
+	changing       sync.RWMutex
+	cache          *recordCache
+	lastSync       syncState
+	driftInterval  time.Duration
+	driftCheckedAt atomic.Pointer[time.Time]
+	// stop ends the goroutines started for the provider
+	stop context.CancelFunc
 }
 
 // NewOpnsenseProvider initializes a new DNSProvider.
-func NewOpnsenseProvider(domainFilter endpoint.DomainFilter, config *Config) (provider.Provider, error) {
-	c, err := newOpnsenseClient(config)
+// Endpoints are routed to the first target whose domain filter matches them.
+// The provider logs in to its targets in the background and reports itself
+// unavailable until that succeeded, so an unreachable firewall doesn't stop it from starting.
+func NewOpnsenseProvider(domainFilter endpoint.DomainFilter, config *ProviderConfig, targets []Target) (provider.Provider, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("provider: no opnsense target configured")
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("provider: %w", err)
+	}
+
+	endpointFilter, err := labels.Parse(config.AnnotationFilter)
+	if err != nil {
+		return nil, fmt.Errorf("provider: invalid annotation filter '%s': %w", config.AnnotationFilter, err)
+	}
+
+	protection, err := newProtection(config)
+	if err != nil {
+		return nil, fmt.Errorf("provider: %w", err)
+	}
+
+	notifier, err := notify.New(&config.Notify)
+	if err != nil {
+		return nil, fmt.Errorf("provider: %w", err)
+	}
 
+	audit, err := newAuditLog(config)
 	if err != nil {
-		return nil, fmt.Errorf("provider: failed to create the opnsense client: %w", err)
+		return nil, fmt.Errorf("provider: %w", err)
 	}
 
 	p := &Provider{
-		client:       c,
-		domainFilter: domainFilter,
+		domainFilter:   domainFilter,
+		endpointFilter: endpointFilter,
+		cache:          &recordCache{ttl: config.CacheTTL},
+		driftInterval:  config.DriftCheckInterval,
+		marker:         config.OwnershipMarker,
+		protection:     protection,
+		audit:          audit,
+		notifier:       notifier,
+		deleteLimits: deleteLimits{
+			max:            config.MaxDeletes,
+			maxPercent:     config.MaxDeletePercent,
+			allowDeleteAll: config.AllowDeleteAll,
+			deleteAllMin:   config.DeleteAllMinRecords,
+			overrideFile:   config.DeleteOverrideFile,
+		},
+	}
+
+	for _, t := range targets {
+		backend := t.Backend
+		if backend == nil {
+			c, err := newClusterClient(t.Config, clientOptions{target: t.Name, audit: audit})
+			if err != nil {
+				audit.Close()
+				return nil, fmt.Errorf("provider: failed to create the opnsense client for target '%s': %w", t.Name, err)
+			}
+			backend = c
+		}
+
+		rt := &target{
+			name:         t.Name,
+			backend:      backend,
+			domainFilter: t.DomainFilter,
+			status:       &statusCheck{backend: backend, interval: config.StatusCheckInterval},
+			connection:   newConnection(),
+			drift:        &driftState{},
+		}
+		rt.managedCount.Store(-1)
+		p.targets = append(p.targets, rt)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	p.stop = stop
+	for _, t := range p.targets {
+		go t.connect(ctx, config.LoginBackoffMax)
+	}
+	if p.driftInterval > 0 {
+		go p.watchDrift(ctx, p.driftInterval)
 	}
 
 	return p, nil
 }
 
+// Close stops the background work of the provider and closes its idle connections.
+// Changes in flight, e.g. of requests still served after a reload, are waited for
+// before the audit log is released, and so are the notifications in flight,
+// without holding up changes that are about to fail as the provider is closed.
+func (p *Provider) Close() error {
+	p.stop()
+	p.changing.Lock()
+	for _, t := range p.targets {
+		t.backend.Close()
+	}
+	p.changing.Unlock()
+
+	p.notifier.Close()
+	p.notifier.Wait()
+	return p.audit.Close()
+}
+
+// Inherit takes over the state p would otherwise rebuild over time from the previous provider
+// it replaces, e.g. on a reload: the drift baseline and the number of managed records of the
+// given targets, which must select the same records on the same firewall in both providers.
+// The record cache and the outcome of the last sync span every target, so they are only carried
+// over if both providers have the same targets and all of them are given.
+// It returns whether they were carried over.
+func (p *Provider) Inherit(previous provider.Provider, targets []string) bool {
+	prev, ok := previous.(*Provider)
+	if !ok {
+		return false
+	}
+
+	inherited := 0
+	for _, t := range p.targets {
+		if !slices.Contains(targets, t.name) {
+			continue
+		}
+		i := slices.IndexFunc(prev.targets, func(pt *target) bool { return pt.name == t.name })
+		if i < 0 {
+			continue
+		}
+		t.drift.inherit(prev.targets[i].drift)
+		t.managedCount.Store(prev.targets[i].managedCount.Load())
+		inherited++
+	}
+
+	if inherited < len(p.targets) || len(prev.targets) != len(p.targets) {
+		return false
+	}
+	p.cache.inherit(prev.cache)
+	p.lastSync.inherit(&prev.lastSync)
+	p.driftCheckedAt.Store(prev.driftCheckedAt.Load())
+	return true
+}
+
 // Records returns the list of HostOverride records in Opnsense Unbound.
-func (p *Provider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
-	log.Debugf("records: retrieving records from opnsense")
+// Records are served from the cache while it is fresh, unless ctx asks to bypass it.
+func (p *Provider) Records(ctx context.Context) (endpoints []*endpoint.Endpoint, err error) {
+	ctx, span := startSpan(ctx, "Provider.Records")
+	defer func() {
+		p.lastSync.observe("records", err)
+		endSpan(span, err)
+	}()
 
-	records, err := p.client.GetHostOverrides()
-	if err != nil {
-		return nil, err
+	if err := p.connected(); err != nil {
+		return nil, unavailable(fmt.Errorf("records: %w", err))
 	}
 
-	var endpoints []*endpoint.Endpoint
-	for _, record := range records {
-		ep := &endpoint.Endpoint{
-			DNSName:    JoinUnboundFQDN(record.Hostname, record.Domain),
-			RecordType: PruneUnboundType(record.Rr),
-			Targets:    endpoint.NewTargets(record.Server),
+	if !cacheBypassed(ctx) {
+		if endpoints, ok := p.cache.get(); ok {
+			span.SetAttributes(attribute.Bool("opnsense.cache_hit", true))
+			requestid.Log(ctx).Debugf("records: returning %d cached records", len(endpoints))
+			return endpoints, nil
 		}
+	}
 
-		if !p.domainFilter.Match(ep.DNSName) {
-			continue
+	token := p.cache.begin()
+	for _, t := range p.targets {
+		requestid.Log(ctx).Debugf("records: retrieving records from opnsense target '%s'", t.name)
+
+		records, err := t.backend.List(ctx)
+		if err != nil {
+			return nil, unavailable(fmt.Errorf("records: target '%s': %w", t.name, err))
 		}
 
-		endpoints = append(endpoints, ep)
+		managed := p.managed(t, records)
+		t.managedCount.Store(int64(len(managed)))
+		t.drift.baseline(managed)
+		for _, record := range managed {
+			endpoints = append(endpoints, recordToEndpoint(record))
+		}
 	}
 
-	log.Debugf("records: retrieved: %+v", endpoints)
+	requestid.Log(ctx).Debugf("records: retrieved: %+v", endpoints)
+	p.cache.set(token, endpoints)
+	setManagedRecords(endpoints)
 
 	return endpoints, nil
 }
 
 // ApplyChanges applies a given set of changes in the DNS provider.
-func (p *Provider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
-	for _, endpoint := range append(changes.UpdateOld, changes.Delete...) {
-		if err := p.client.DeleteHostOverride(endpoint); err != nil {
+func (p *Provider) ApplyChanges(ctx context.Context, changes *plan.Changes) (err error) {
+	ctx, span := startSpan(ctx, "Provider.ApplyChanges", trace.WithAttributes(
+		attribute.Int("changes.create", len(changes.Create)),
+		attribute.Int("changes.update", len(changes.UpdateNew)),
+		attribute.Int("changes.delete", len(changes.Delete)),
+	))
+	defer func() {
+		p.lastSync.observe("apply", err)
+		endSpan(span, err)
+	}()
+
+	p.changing.RLock()
+	defer p.changing.RUnlock()
+
+	if err := p.connected(); err != nil {
+		return unavailable(fmt.Errorf("apply: %w", err))
+	}
+
+	// Even a failed batch may have changed some records, so never keep serving the old ones
+	defer p.cache.invalidate()
+
+	routed := p.routeChanges(ctx, p.filterChanges(ctx, changes))
+	if err := p.protectChanges(ctx, routed); err != nil {
+		return err
+	}
+	if err := p.checkDeleteLimits(ctx, routed); err != nil {
+		return err
+	}
+	for _, t := range p.targets {
+		tc, ok := routed[t]
+		if !ok || !tc.HasChanges() {
+			continue
+		}
+
+		if err := p.applyChanges(ctx, t, tc); err != nil {
+			return unavailable(fmt.Errorf("apply: target '%s': %w", t.name, err))
+		}
+	}
+
+	lastApplySuccess.SetToCurrentTime()
+	blockedDeletes.Set(0)
+	p.notifier.Notify(ctx, p.summarize(routed))
+	return nil
+}
+
+// filterChanges drops the creates and updates of endpoints not matching the annotation filter.
+// Deletes are never filtered, the records read from OPNsense carry neither labels nor annotations.
+func (p *Provider) filterChanges(ctx context.Context, changes *plan.Changes) *plan.Changes {
+	if p.endpointFilter.Empty() {
+		return changes
+	}
+
+	filtered := &plan.Changes{Delete: changes.Delete}
+	for _, ep := range changes.Create {
+		if p.matchesEndpointFilter(ctx, ep) {
+			filtered.Create = append(filtered.Create, ep)
+		}
+	}
+	// UpdateOld and UpdateNew are pairs, keep or drop both so a skipped update doesn't turn into a delete
+	for i, ep := range changes.UpdateNew {
+		if i < len(changes.UpdateOld) && p.matchesEndpointFilter(ctx, ep) {
+			filtered.UpdateOld = append(filtered.UpdateOld, changes.UpdateOld[i])
+			filtered.UpdateNew = append(filtered.UpdateNew, ep)
+		}
+	}
+	return filtered
+}
+
+// matchesEndpointFilter matches the labels and provider specific properties of ep against the annotation filter.
+func (p *Provider) matchesEndpointFilter(ctx context.Context, ep *endpoint.Endpoint) bool {
+	set := labels.Set{}
+	for key, value := range ep.Labels {
+		set[key] = value
+	}
+	for _, property := range ep.ProviderSpecific {
+		set[property.Name] = property.Value
+	}
+
+	if !p.endpointFilter.Matches(set) {
+		requestid.Log(ctx).Debugf("apply: %s %s doesn't match the annotation filter '%s', skipping it", ep.RecordType, ep.DNSName, p.endpointFilter)
+		return false
+	}
+	return true
+}
+
+// routeChanges splits changes up by the target responsible for each endpoint.
+func (p *Provider) routeChanges(ctx context.Context, changes *plan.Changes) map[*target]*plan.Changes {
+	routed := make(map[*target]*plan.Changes)
+	route := func(endpoints []*endpoint.Endpoint, field func(*plan.Changes) *[]*endpoint.Endpoint) {
+		for _, ep := range endpoints {
+			t := p.targetFor(ep.DNSName)
+			if t == nil {
+				requestid.Log(ctx).Warnf("apply: no opnsense target matches %s, skipping it", ep.DNSName)
+				continue
+			}
+			if routed[t] == nil {
+				routed[t] = &plan.Changes{}
+			}
+			f := field(routed[t])
+			*f = append(*f, ep)
+		}
+	}
+
+	route(changes.Create, func(c *plan.Changes) *[]*endpoint.Endpoint { return &c.Create })
+	route(changes.UpdateOld, func(c *plan.Changes) *[]*endpoint.Endpoint { return &c.UpdateOld })
+	route(changes.UpdateNew, func(c *plan.Changes) *[]*endpoint.Endpoint { return &c.UpdateNew })
+	route(changes.Delete, func(c *plan.Changes) *[]*endpoint.Endpoint { return &c.Delete })
+
+	return routed
+}
+
+// targetFor returns the first target whose domain filter matches name, or nil if none does.
+func (p *Provider) targetFor(name string) *target {
+	for _, t := range p.targets {
+		if t.domainFilter.Match(name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// applyChanges applies the changes routed to target t.
+func (p *Provider) applyChanges(ctx context.Context, t *target, changes *plan.Changes) (err error) {
+	ctx, span := startSpan(ctx, "target.applyChanges", trace.WithAttributes(attribute.String("opnsense.target", t.name)))
+	defer func() {
+		t.managedCount.Store(-1)
+		// A failed batch may have applied some of the changes, so the records to expect are unknown
+		if err != nil {
+			t.drift.forget()
+		} else {
+			t.drift.applied(changes)
+		}
+		endSpan(span, err)
+	}()
+
+	for _, ep := range changes.Delete {
+		if err := t.backend.Delete(ctx, endpointToRecord(ep, p.marker)); err != nil {
 			return err
 		}
 	}
 
-	for _, endpoint := range append(changes.Create, changes.UpdateNew...) {
-		if _, err := p.client.CreateHostOverride(endpoint); err != nil {
+	// UpdateOld and UpdateNew are pairs, see filterChanges
+	for i, ep := range changes.UpdateNew {
+		if i >= len(changes.UpdateOld) {
+			break
+		}
+		err := t.backend.Update(ctx, endpointToRecord(changes.UpdateOld[i], p.marker), endpointToRecord(ep, p.marker))
+		if errors.Is(err, errRecordNotFound) {
+			requestid.Log(ctx).Debugf("apply: the %s record for %s to update is gone, creating it", ep.RecordType, ep.DNSName)
+			err = p.create(ctx, t, ep)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
-	p.client.ReconfigureUnbound()
+	for _, ep := range changes.Create {
+		if err := p.create(ctx, t, ep); err != nil {
+			return err
+		}
+	}
 
+	if err := t.backend.Apply(ctx); err != nil {
+		return err
+	}
+
+	if r, ok := t.backend.(reconciler); ok {
+		if err := r.reconcile(ctx, func(record Record) bool { return p.manages(t, record) }); err != nil {
+			requestid.Log(ctx).Warnf("apply: reconciling hosts of target '%s' failed: %v", t.name, err)
+		}
+	}
+
+	return nil
+}
+
+// create creates the record for ep on target t, warning if an unmanaged record of the same name and type exists already.
+func (p *Provider) create(ctx context.Context, t *target, ep *endpoint.Endpoint) error {
+	existing, err := t.backend.Create(ctx, endpointToRecord(ep, p.marker))
+	if err != nil {
+		return err
+	}
+	if existing != nil && !ownedBy(*existing, p.marker) {
+		requestid.Log(ctx).Warnf("apply: an unmanaged %s record for %s exists already, adopt it to manage it", ep.RecordType, ep.DNSName)
+	}
 	return nil
 }
 
+// managed returns the records of a target matched by both the provider's and the target's domain filter,
+// carrying the ownership marker if one is configured and not protected.
+func (p *Provider) managed(t *target, records []Record) []Record {
+	var result []Record
+	for _, record := range records {
+		if p.manages(t, record) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// manages reports whether the provider manages record on target t, see managed.
+func (p *Provider) manages(t *target, record Record) bool {
+	return p.domainFilter.Match(record.Name) && t.domainFilter.Match(record.Name) && ownedBy(record, p.marker) && !p.protection.record(record)
+}
+
 // GetDomainFilter returns the domain filter for the provider.
 func (p *Provider) GetDomainFilter() endpoint.DomainFilter {
 	return p.domainFilter
 }
+
+// unavailableError marks errors caused by OPNsense being unreachable,
+// which the webhook reports as 503 Service Unavailable instead of 500.
+type unavailableError struct {
+	error
+}
+
+func (e unavailableError) Unwrap() error {
+	return e.error
+}
+
+// Unavailable reports that the backend can't serve requests right now.
+func (e unavailableError) Unavailable() bool {
+	return true
+}
+
+// refusedError marks batches refused by policy, e.g. the delete limits or protected records.
+// They don't fail the readiness sync check, the firewall was reachable and nothing went wrong.
+type refusedError struct {
+	error
+}
+
+func (e refusedError) Unwrap() error {
+	return e.error
+}
+
+// unavailable wraps err in an unavailableError if no firewall could be reached.
+func unavailable(err error) error {
+	if errors.Is(err, errUnreachable) {
+		return unavailableError{err}
+	}
+	return err
+}
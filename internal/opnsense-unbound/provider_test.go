@@ -0,0 +1,363 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func memoryRecord(name, target, description string) Record {
+	return Record{Name: name, Type: "A", Target: target, Enabled: true, Description: description}
+}
+
+// newTestProvider creates a provider for targets backed by MemoryBackends and waits until it is connected.
+func newTestProvider(t *testing.T, domains []string, config ProviderConfig, targets ...Target) *Provider {
+	t.Helper()
+	if config.ProtectedAction == "" {
+		config.ProtectedAction = ProtectedActionSkip
+	}
+	p, err := NewOpnsenseProvider(endpoint.NewDomainFilter(domains), &config, targets)
+	if err != nil {
+		t.Fatalf("NewOpnsenseProvider: %v", err)
+	}
+	t.Cleanup(func() { p.(*Provider).Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.(*Provider).WaitConnected(ctx); err != nil {
+		t.Fatalf("WaitConnected: %v", err)
+	}
+	return p.(*Provider)
+}
+
+// memoryTarget is a target matching every domain, backed by a MemoryBackend holding records.
+func memoryTarget(records ...Record) (Target, *MemoryBackend) {
+	backend := NewMemoryBackend(records...)
+	return Target{Name: DefaultTargetName, Backend: backend}, backend
+}
+
+func endpointNames(endpoints []*endpoint.Endpoint) []string {
+	var names []string
+	for _, ep := range endpoints {
+		names = append(names, ep.DNSName)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func recordNames(records []Record) []string {
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestProviderRecordsMatchTheDomainFilter(t *testing.T) {
+	target, _ := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+		memoryRecord("app.example.com", "192.168.1.20", ""),
+		memoryRecord("www.example.org", "192.168.1.30", ""),
+	)
+	p := newTestProvider(t, []string{"example.com"}, ProviderConfig{}, target)
+
+	endpoints, err := p.Records(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := endpointNames(endpoints), []string{"app.example.com", "nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v, want %v", got, want)
+	}
+}
+
+func TestProviderOnlyManagesRecordsCarryingTheMarker(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", "external-dns"),
+		memoryRecord("router.example.com", "192.168.1.1", "set up by hand"),
+	)
+	p := newTestProvider(t, nil, ProviderConfig{OwnershipMarker: "external-dns", AllowDeleteAll: true}, target)
+	ctx := context.Background()
+
+	endpoints, err := p.Records(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := endpointNames(endpoints), []string{"nas.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v, want %v", got, want)
+	}
+
+	err = p.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20")},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10"),
+			endpoint.NewEndpoint("router.example.com", "A", "192.168.1.1"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := backend.Records()
+	if got, want := recordNames(records), []string{"app.example.com", "router.example.com"}; !slices.Equal(got, want) {
+		t.Fatalf("backend holds %v, want %v", got, want)
+	}
+	for _, r := range records {
+		if r.Name == "app.example.com" && r.Description != "external-dns" {
+			t.Errorf("the created record is described as %q, want the marker", r.Description)
+		}
+	}
+}
+
+func TestProviderUpdatesRecordsInPlace(t *testing.T) {
+	target, backend := memoryTarget(memoryRecord("nas.example.com", "192.168.1.10", "storage external-dns"))
+	p := newTestProvider(t, nil, ProviderConfig{OwnershipMarker: "external-dns"}, target)
+	before := backend.Records()[0]
+
+	err := p.ApplyChanges(context.Background(), &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.11")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := backend.Records()
+	if len(after) != 1 {
+		t.Fatalf("backend holds %d records, want 1", len(after))
+	}
+	if after[0].ID != before.ID || after[0].Target != "192.168.1.11" || after[0].Description != "storage external-dns" {
+		t.Errorf("updated record = %+v, want %s pointing to 192.168.1.11 keeping its description", after[0], before.ID)
+	}
+}
+
+func TestProviderRoutesChangesToTargets(t *testing.T) {
+	siteA, siteB := NewMemoryBackend(), NewMemoryBackend()
+	p := newTestProvider(t, nil, ProviderConfig{},
+		Target{Name: "site-a", DomainFilter: endpoint.NewDomainFilter([]string{"a.example.com"}), Backend: siteA},
+		Target{Name: "site-b", DomainFilter: endpoint.NewDomainFilter([]string{"b.example.com"}), Backend: siteB},
+	)
+
+	err := p.ApplyChanges(context.Background(), &plan.Changes{Create: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("nas.a.example.com", "A", "192.168.1.10"),
+		endpoint.NewEndpoint("nas.b.example.com", "A", "192.168.2.10"),
+		endpoint.NewEndpoint("nas.c.example.com", "A", "192.168.3.10"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := recordNames(siteA.Records()), []string{"nas.a.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("site-a holds %v, want %v", got, want)
+	}
+	if got, want := recordNames(siteB.Records()), []string{"nas.b.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("site-b holds %v, want %v", got, want)
+	}
+}
+
+func TestProviderLeavesProtectedRecordsAlone(t *testing.T) {
+	records := []Record{
+		memoryRecord("router.example.com", "192.168.1.1", ""),
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+	}
+	changes := func() *plan.Changes {
+		return &plan.Changes{Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("router.example.com", "A", "192.168.1.1"),
+			endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10"),
+		}}
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		target, backend := memoryTarget(records...)
+		p := newTestProvider(t, nil, ProviderConfig{ProtectedRecords: []string{"router.example.com"}, AllowDeleteAll: true}, target)
+
+		if err := p.ApplyChanges(context.Background(), changes()); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := recordNames(backend.Records()), []string{"router.example.com"}; !slices.Equal(got, want) {
+			t.Errorf("backend holds %v, want %v", got, want)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		target, backend := memoryTarget(records...)
+		p := newTestProvider(t, nil, ProviderConfig{ProtectedRecords: []string{"router.example.com"}, ProtectedAction: ProtectedActionError, AllowDeleteAll: true}, target)
+
+		if err := p.ApplyChanges(context.Background(), changes()); err == nil {
+			t.Fatal("ApplyChanges succeeded, want the protected record to fail the batch")
+		}
+		if got := backend.Records(); len(got) != 2 {
+			t.Errorf("backend holds %v after a refused batch, want both records", recordNames(got))
+		}
+	})
+}
+
+func TestProviderRefusesBatchesExceedingTheDeleteLimits(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+		memoryRecord("app.example.com", "192.168.1.20", ""),
+		memoryRecord("www.example.com", "192.168.1.30", ""),
+	)
+	p := newTestProvider(t, nil, ProviderConfig{MaxDeletes: 1, AllowDeleteAll: true}, target)
+
+	err := p.ApplyChanges(context.Background(), &plan.Changes{Delete: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10"),
+		endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20"),
+	}})
+	if err == nil {
+		t.Fatal("ApplyChanges succeeded, want the batch to be refused")
+	}
+	if got := backend.Records(); len(got) != 3 {
+		t.Errorf("backend holds %v after a refused batch, want every record", recordNames(got))
+	}
+	if backend.Applied() != 0 {
+		t.Errorf("a refused batch was applied")
+	}
+}
+
+func TestTargetForPicksTheFirstMatchingTarget(t *testing.T) {
+	p := newTestProvider(t, nil, ProviderConfig{},
+		Target{Name: "lab", DomainFilter: endpoint.NewDomainFilter([]string{"lab.example.com"}), Backend: NewMemoryBackend()},
+		Target{Name: "home", DomainFilter: endpoint.NewDomainFilter([]string{"example.com"}), Backend: NewMemoryBackend()},
+	)
+
+	for name, want := range map[string]string{
+		"nas.lab.example.com": "lab",
+		"nas.example.com":     "home",
+		"nas.example.org":     "",
+	} {
+		got := ""
+		if target := p.targetFor(name); target != nil {
+			got = target.name
+		}
+		if got != want {
+			t.Errorf("targetFor(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRouteChangesKeepsUpdatePairsTogether(t *testing.T) {
+	p := newTestProvider(t, nil, ProviderConfig{},
+		Target{Name: "site-a", DomainFilter: endpoint.NewDomainFilter([]string{"a.example.com"}), Backend: NewMemoryBackend()},
+		Target{Name: "site-b", DomainFilter: endpoint.NewDomainFilter([]string{"b.example.com"}), Backend: NewMemoryBackend()},
+	)
+	ctx := context.Background()
+
+	routed := p.routeChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.b.example.com", "A", "192.168.2.20")},
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.a.example.com", "A", "192.168.1.10"),
+			endpoint.NewEndpoint("nas.b.example.com", "A", "192.168.2.10"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("nas.a.example.com", "A", "192.168.1.11"),
+			endpoint.NewEndpoint("nas.b.example.com", "A", "192.168.2.11"),
+		},
+		Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("old.example.org", "A", "192.168.3.10")},
+	})
+
+	if len(routed) != 2 {
+		t.Fatalf("changes were routed to %d targets, want 2", len(routed))
+	}
+	for _, target := range p.targets {
+		tc := routed[target]
+		if len(tc.UpdateOld) != 1 || len(tc.UpdateNew) != 1 || tc.UpdateOld[0].DNSName != tc.UpdateNew[0].DNSName {
+			t.Errorf("target '%s' got updates %v -> %v, want a single pair", target.name, tc.UpdateOld, tc.UpdateNew)
+		}
+		if len(tc.Delete) != 0 {
+			t.Errorf("target '%s' got the delete of a name no target matches", target.name)
+		}
+	}
+	if b := routed[p.targets[1]]; len(b.Create) != 1 || b.Create[0].DNSName != "app.b.example.com" {
+		t.Errorf("site-b got creates %v, want app.b.example.com", b.Create)
+	}
+}
+
+func TestProviderRecordsMergesTargets(t *testing.T) {
+	siteA := NewMemoryBackend(
+		memoryRecord("nas.a.example.com", "192.168.1.10", ""),
+		// Outside the filter of its target, e.g. a record the other target is responsible for
+		memoryRecord("nas.b.example.com", "192.168.1.99", ""),
+	)
+	siteB := NewMemoryBackend(
+		memoryRecord("nas.b.example.com", "192.168.2.10", ""),
+		memoryRecord("nas.example.org", "192.168.2.20", ""),
+	)
+	p := newTestProvider(t, []string{"example.com"}, ProviderConfig{},
+		Target{Name: "site-a", DomainFilter: endpoint.NewDomainFilter([]string{"a.example.com"}), Backend: siteA},
+		Target{Name: "site-b", DomainFilter: endpoint.NewDomainFilter([]string{"b.example.com"}), Backend: siteB},
+	)
+
+	endpoints, err := p.Records(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ep := range endpoints {
+		got = append(got, ep.DNSName+" "+ep.Targets[0])
+	}
+	slices.Sort(got)
+	if want := []string{"nas.a.example.com 192.168.1.10", "nas.b.example.com 192.168.2.10"}; !slices.Equal(got, want) {
+		t.Errorf("Records = %v, want %v", got, want)
+	}
+
+	// A target failing to list its records fails the whole call rather than returning a partial set
+	siteB.SetError(errors.New("unreachable"))
+	if _, err := p.Records(context.Background()); err == nil {
+		t.Error("Records succeeded although a target failed")
+	}
+}
+
+func TestInheritCarriesOverTheStateOfThePreviousProvider(t *testing.T) {
+	target, backend := memoryTarget(
+		memoryRecord("nas.example.com", "192.168.1.10", ""),
+		memoryRecord("app.example.com", "192.168.1.20", ""),
+	)
+	previous := newTestProvider(t, nil, ProviderConfig{}, target)
+	ctx := context.Background()
+
+	if _, err := previous.Records(ctx); err != nil {
+		t.Fatal(err)
+	}
+	backend.SetError(errors.New("unreachable"))
+	if _, err := previous.Records(ctx); err == nil {
+		t.Fatal("Records succeeded although the target failed")
+	}
+	backend.SetError(nil)
+	if err := backend.Delete(ctx, memoryRecord("app.example.com", "", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unchanged targets", func(t *testing.T) {
+		p := newTestProvider(t, nil, ProviderConfig{}, target)
+		if !p.Inherit(previous, []string{DefaultTargetName}) {
+			t.Fatal("Inherit didn't carry over the state spanning every target")
+		}
+		if err := p.lastSync.status(); err == nil {
+			t.Error("the failed sync of the previous provider wasn't carried over")
+		}
+		p.checkDrift(ctx)
+		if report := p.Drift().Targets[0]; report.Status != DriftStatusDrifted {
+			t.Errorf("drift report = %+v, want the record removed since the previous provider read it", report)
+		}
+	})
+
+	t.Run("changed targets", func(t *testing.T) {
+		p := newTestProvider(t, nil, ProviderConfig{}, target)
+		if p.Inherit(previous, nil) {
+			t.Fatal("Inherit carried over the state spanning every target although the targets changed")
+		}
+		if err := p.lastSync.status(); err != nil {
+			t.Errorf("sync state = %v, want it to start over", err)
+		}
+		p.checkDrift(ctx)
+		if report := p.Drift().Targets[0]; report.Status != DriftStatusUnknown {
+			t.Errorf("drift report = %+v, want the baseline to start over", report)
+		}
+	})
+}
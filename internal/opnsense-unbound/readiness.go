@@ -0,0 +1,125 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+)
+
+// statusCheck calls service/status on a target, reusing the result for interval
+// so frequent readiness probes don't turn into requests against the firewall.
+// Probes arriving while a check is running get the previous result instead of waiting for it.
+type statusCheck struct {
+	backend  Backend
+	interval time.Duration
+
+	mu        sync.Mutex
+	checking  bool
+	checkedAt time.Time
+	err       error
+}
+
+func (s *statusCheck) check(ctx context.Context) error {
+	s.mu.Lock()
+	if s.checking || (!s.checkedAt.IsZero() && time.Since(s.checkedAt) < s.interval) {
+		defer s.mu.Unlock()
+		return s.err
+	}
+	s.checking = true
+	s.mu.Unlock()
+
+	err := s.backend.Status(ctx)
+	if err != nil {
+		requestid.Log(ctx).Warnf("readiness: status check failed: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checking = false
+	s.checkedAt = time.Now()
+	s.err = err
+	return err
+}
+
+// syncState remembers the outcome of the last Records and the last ApplyChanges call,
+// so reading the records successfully doesn't hide a batch that failed to apply.
+// Batches refused by policy don't change the outcome.
+type syncState struct {
+	mu      sync.Mutex
+	records error
+	apply   error
+}
+
+func (s *syncState) observe(operation string, err error) {
+	if errors.As(err, &refusedError{}) {
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("last %s failed: %w", operation, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch operation {
+	case "records":
+		s.records = err
+	case "apply":
+		s.apply = err
+	}
+}
+
+// inherit takes over the outcome of the last sync of previous.
+func (s *syncState) inherit(previous *syncState) {
+	previous.mu.Lock()
+	records, apply := previous.records, previous.apply
+	previous.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records, s.apply = records, apply
+}
+
+func (s *syncState) status() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.records, s.apply)
+}
+
+// Ready reports whether every target is connected, its service/status call recently succeeded
+// and the last sync didn't fail. The health of every host is reported as well,
+// but a single unreachable host doesn't make the provider unready.
+func (p *Provider) Ready(ctx context.Context) (bool, map[string]error) {
+	checks := make(map[string]error)
+	ready := true
+
+	for _, t := range p.targets {
+		err := t.connection.status()
+		if err == nil {
+			err = t.status.check(ctx)
+		}
+		checks[p.checkName(t, "status")] = err
+		ready = ready && err == nil
+
+		for host, err := range t.backend.Health() {
+			checks[p.checkName(t, "host "+host)] = err
+		}
+	}
+
+	err := p.lastSync.status()
+	checks["sync"] = err
+	ready = ready && err == nil
+
+	return ready, checks
+}
+
+// checkName prefixes a readiness check with the target name when more than one target is configured.
+func (p *Provider) checkName(t *target, check string) string {
+	if len(p.targets) == 1 {
+		return check
+	}
+	return fmt.Sprintf("target %s %s", t.name, check)
+}
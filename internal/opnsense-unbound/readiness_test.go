@@ -0,0 +1,98 @@
+package opnsense
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestReadyTracksRecordsAndApplySeparately(t *testing.T) {
+	target, backend := memoryTarget(limitRecords(3)...)
+	p := newTestProvider(t, nil, ProviderConfig{MaxDeletes: 1, DeleteAllMinRecords: 3}, target)
+	ctx := context.Background()
+	create := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("app.example.com", "A", "192.168.1.20")}}
+
+	if ready, checks := p.Ready(ctx); !ready {
+		t.Fatalf("Ready = false before any sync: %v", checks)
+	}
+
+	backend.SetError(errors.New("write failed"))
+	if err := p.ApplyChanges(ctx, create); err == nil {
+		t.Fatal("ApplyChanges succeeded although the backend failed")
+	}
+	backend.SetError(nil)
+	if _, err := p.Records(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ready, _ := p.Ready(ctx); ready {
+		t.Error("Ready = true after a failed apply, reading the records hid the failure")
+	}
+
+	// A refused batch is no sync failure, nor does it clear one
+	if err := p.ApplyChanges(ctx, &plan.Changes{Delete: limitDeletes(2)}); err == nil {
+		t.Fatal("ApplyChanges succeeded although the batch exceeds the delete limits")
+	}
+	if ready, _ := p.Ready(ctx); ready {
+		t.Error("Ready = true after a refused batch, want the failed apply reported still")
+	}
+
+	if err := p.ApplyChanges(ctx, create); err != nil {
+		t.Fatal(err)
+	}
+	if ready, checks := p.Ready(ctx); !ready {
+		t.Errorf("Ready = false after a successful apply: %v", checks)
+	}
+
+	if err := p.ApplyChanges(ctx, &plan.Changes{Delete: limitDeletes(2)}); err == nil {
+		t.Fatal("ApplyChanges succeeded although the batch exceeds the delete limits")
+	}
+	if ready, checks := p.Ready(ctx); !ready {
+		t.Errorf("Ready = false after a refused batch: %v", checks)
+	}
+}
+
+// blockingStatus is a backend whose Status calls wait until release is closed.
+type blockingStatus struct {
+	*MemoryBackend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStatus) Status(ctx context.Context) error {
+	close(b.started)
+	<-b.release
+	return errors.New("status failed")
+}
+
+func TestStatusCheckDoesNotBlockConcurrentProbes(t *testing.T) {
+	backend := &blockingStatus{MemoryBackend: NewMemoryBackend(), started: make(chan struct{}), release: make(chan struct{})}
+	s := &statusCheck{backend: backend, interval: time.Minute}
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() { done <- s.check(ctx) }()
+	<-backend.started
+
+	probed := make(chan error)
+	go func() { probed <- s.check(ctx) }()
+	select {
+	case err := <-probed:
+		if err != nil {
+			t.Errorf("a probe during the first check returned %v, want the previous result", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a probe waited for the running status check")
+	}
+
+	close(backend.release)
+	if err := <-done; err == nil {
+		t.Error("the status check succeeded, want the error of the backend")
+	}
+	if err := s.check(ctx); err == nil {
+		t.Error("the cached result was lost")
+	}
+}
@@ -0,0 +1,33 @@
+package opnsense
+
+import (
+	"context"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDAttribute holds the ID of the webhook request a span belongs to, as logged with requestid.LogField
+const requestIDAttribute = "request.id"
+
+var tracer = otel.Tracer("github.com/crutonjohn/external-dns-opnsense-webhook/internal/opnsense-unbound")
+
+// startSpan starts a span carrying the request ID of ctx, if any, so traces can be found from the logs.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if id := requestid.FromContext(ctx); id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String(requestIDAttribute, id)))
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,103 @@
+package opnsense
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var (
+	spanRecorder    = tracetest.NewSpanRecorder()
+	installRecorder sync.Once
+)
+
+// recordSpans installs spanRecorder as the global tracer provider. The package tracer sticks to
+// the first provider installed, so every test shares the recorder and tells its spans apart by trace.
+func recordSpans() *tracetest.SpanRecorder {
+	installRecorder.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+func TestProviderSpans(t *testing.T) {
+	recorder := recordSpans()
+	f := newFakeUnbound(t)
+	p := newTestProvider(t, nil, ProviderConfig{}, Target{
+		Name:   DefaultTargetName,
+		Config: &Config{Hosts: []string{f.URL}, HAMode: HAModeFailover, Key: "key", Secret: "secret"},
+	})
+
+	for _, tc := range []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{name: "Provider.Records", call: func(ctx context.Context) error {
+			_, err := p.Records(WithCacheBypass(ctx))
+			return err
+		}},
+		{name: "Provider.ApplyChanges", call: func(ctx context.Context) error {
+			return p.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("nas.example.com", "A", "192.168.1.10")}})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id := "request-" + strings.ToLower(tc.name)
+			if err := tc.call(requestid.NewContext(context.Background(), id)); err != nil {
+				t.Fatal(err)
+			}
+
+			var root sdktrace.ReadOnlySpan
+			for _, span := range recorder.Ended() {
+				if span.Name() == tc.name && spanAttribute(span, requestIDAttribute) == id {
+					root = span
+				}
+			}
+			if root == nil {
+				t.Fatalf("no %s span with the request ID %s was recorded", tc.name, id)
+			}
+
+			// The API calls are children of the root span, the HTTP requests children of the API calls
+			apiCalls := make(map[string]bool)
+			requests := 0
+			for _, span := range recorder.Ended() {
+				if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+					continue
+				}
+				switch {
+				case strings.HasPrefix(span.Name(), "opnsense "):
+					if got := spanAttribute(span, requestIDAttribute); got != id {
+						t.Errorf("span %s has the request ID %q, want %q", span.Name(), got, id)
+					}
+					apiCalls[span.SpanContext().SpanID().String()] = true
+				case strings.HasPrefix(span.Name(), "HTTP "):
+					requests++
+				}
+			}
+			if len(apiCalls) == 0 || requests == 0 {
+				t.Fatalf("recorded %d API call and %d HTTP request spans in the trace, want some of both", len(apiCalls), requests)
+			}
+			for _, span := range recorder.Ended() {
+				if span.SpanContext().TraceID() == root.SpanContext().TraceID() && strings.HasPrefix(span.Name(), "HTTP ") && !apiCalls[span.Parent().SpanID().String()] {
+					t.Errorf("HTTP request span %s isn't a child of an API call span", span.Name())
+				}
+			}
+		})
+	}
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
@@ -1,11 +1,125 @@
 package opnsense
 
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/notify"
+)
+
+const (
+	// HAModeFailover sends every request to the first reachable host
+	HAModeFailover = "failover"
+	// HAModeAll writes changes to every host and reconciles them afterwards
+	HAModeAll = "all"
+)
+
 // Config represents the configuration for the UniFi API.
 type Config struct {
-	Host          string `env:"OPNSENSE_HOST,notEmpty"`
-	Key           string `env:"OPNSENSE_API_KEY,notEmpty"`
-	Secret        string `env:"OPNSENSE_API_SECRET,notEmpty"`
-	SkipTLSVerify bool   `env:"OPNSENSE_SKIP_TLS_VERIFY" envDefault:"true"`
+	Hosts                   []string      `env:"OPNSENSE_HOST,notEmpty" yaml:"hosts"`
+	HAMode                  string        `env:"OPNSENSE_HA_MODE" envDefault:"failover" yaml:"haMode"`
+	HostRetryInterval       time.Duration `env:"OPNSENSE_HOST_RETRY_INTERVAL" envDefault:"30s" yaml:"hostRetryInterval"`
+	Key                     string        `env:"OPNSENSE_API_KEY" yaml:"apiKey"`
+	KeyFile                 string        `env:"OPNSENSE_API_KEY_FILE" yaml:"apiKeyFile"`
+	Secret                  string        `env:"OPNSENSE_API_SECRET" yaml:"apiSecret"`
+	SecretFile              string        `env:"OPNSENSE_API_SECRET_FILE" yaml:"apiSecretFile"`
+	SkipTLSVerify           bool          `env:"OPNSENSE_SKIP_TLS_VERIFY" envDefault:"true" yaml:"skipTLSVerify"`
+	RateLimit               float64       `env:"OPNSENSE_RATE_LIMIT" envDefault:"0" yaml:"rateLimit"`
+	RateBurst               int           `env:"OPNSENSE_RATE_BURST" envDefault:"1" yaml:"rateBurst"`
+	MaxConcurrentRequests   int           `env:"OPNSENSE_MAX_CONCURRENT_REQUESTS" envDefault:"0" yaml:"maxConcurrentRequests"`
+	BreakerThreshold        int           `env:"OPNSENSE_BREAKER_THRESHOLD" envDefault:"5" yaml:"breakerThreshold"`
+	BreakerOpenDuration     time.Duration `env:"OPNSENSE_BREAKER_OPEN_DURATION" envDefault:"30s" yaml:"breakerOpenDuration"`
+	BreakerHalfOpenRequests int           `env:"OPNSENSE_BREAKER_HALF_OPEN_REQUESTS" envDefault:"1" yaml:"breakerHalfOpenRequests"`
+}
+
+// Validate reports settings that can't work, before any client is created.
+func (c *Config) Validate() error {
+	if c.HAMode != HAModeFailover && c.HAMode != HAModeAll {
+		return fmt.Errorf("unknown ha mode '%s', must be one of '%s' or '%s'", c.HAMode, HAModeFailover, HAModeAll)
+	}
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("no host configured")
+	}
+	for _, host := range c.Hosts {
+		u, err := url.Parse(host)
+		if err != nil {
+			return fmt.Errorf("host '%s': %w", host, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("host '%s' must be an http or https url, e.g. https://192.168.1.1", host)
+		}
+	}
+	return nil
+}
+
+// ProviderConfig holds the settings that apply to the provider as a whole rather than to a single target.
+type ProviderConfig struct {
+	CacheTTL            time.Duration `env:"OPNSENSE_CACHE_TTL" envDefault:"0s" yaml:"cacheTTL"`
+	StatusCheckInterval time.Duration `env:"OPNSENSE_STATUS_CHECK_INTERVAL" envDefault:"30s" yaml:"statusCheckInterval"`
+	LoginBackoffMax     time.Duration `env:"OPNSENSE_LOGIN_BACKOFF_MAX" envDefault:"1m" yaml:"loginBackoffMax"`
+	// DriftCheckInterval is how often the records are compared against the ones the webhook applied, zero disables it
+	DriftCheckInterval time.Duration `env:"OPNSENSE_DRIFT_CHECK_INTERVAL" envDefault:"0s" yaml:"driftCheckInterval"`
+	// AnnotationFilter is a label selector endpoints have to match to be created or updated
+	AnnotationFilter string `env:"ANNOTATION_FILTER" yaml:"annotationFilter"`
+	// OwnershipMarker is written to the description of the records the webhook creates.
+	// If set, only records carrying it are managed.
+	OwnershipMarker string `env:"OPNSENSE_OWNERSHIP_MARKER" yaml:"ownershipMarker"`
+	// ProtectedRecords are names, addresses or uuids of records the webhook must never change,
+	// matched exactly, as a glob or as a /regular expression/. They are separated by semicolons,
+	// which neither names nor the regular expressions matching them need, unlike commas.
+	ProtectedRecords []string `env:"OPNSENSE_PROTECTED_RECORDS" envDefault:"" envSeparator:";" yaml:"protectedRecords"`
+	// ProtectedAction is what happens to changes of protected records, ProtectedActionSkip or ProtectedActionError
+	ProtectedAction string `env:"OPNSENSE_PROTECTED_ACTION" envDefault:"skip" yaml:"protectedAction"`
+	// MaxDeletes is the most records a single batch may delete, zero disables the limit
+	MaxDeletes int `env:"OPNSENSE_MAX_DELETES" envDefault:"0" yaml:"maxDeletes"`
+	// MaxDeletePercent is the most a batch may delete of the records a target manages, zero disables the limit
+	MaxDeletePercent float64 `env:"OPNSENSE_MAX_DELETE_PERCENT" envDefault:"0" yaml:"maxDeletePercent"`
+	// AllowDeleteAll lets a batch delete every record a target manages
+	AllowDeleteAll bool `env:"OPNSENSE_ALLOW_DELETE_ALL" envDefault:"false" yaml:"allowDeleteAll"`
+	// DeleteAllMinRecords is how many records a target has to manage before deleting all of them is refused
+	DeleteAllMinRecords int `env:"OPNSENSE_DELETE_ALL_MIN_RECORDS" envDefault:"3" yaml:"deleteAllMinRecords"`
+	// DeleteOverrideFile lets a single batch exceeding the limits through while it exists
+	DeleteOverrideFile string `env:"OPNSENSE_DELETE_OVERRIDE_FILE" yaml:"deleteOverrideFile"`
+	// AuditLog is where every change sent to OPNsense is recorded, AuditStdout or a file, empty disables it
+	AuditLog string `env:"AUDIT_LOG" yaml:"auditLog"`
+	// AuditLogMaxSize is the size in megabytes after which the audit log file is rotated, zero never rotates
+	AuditLogMaxSize int `env:"AUDIT_LOG_MAX_SIZE" envDefault:"100" yaml:"auditLogMaxSize"`
+	// AuditLogMaxBackups is the number of rotated audit log files kept
+	AuditLogMaxBackups int `env:"AUDIT_LOG_MAX_BACKUPS" envDefault:"5" yaml:"auditLogMaxBackups"`
+	// Notify posts a summary of every applied batch to outbound webhooks
+	Notify notify.Config `yaml:"notify"`
+}
+
+// Validate reports provider settings that can't work, before the provider is created.
+func (c *ProviderConfig) Validate() error {
+	if strings.ContainsFunc(c.OwnershipMarker, unicode.IsSpace) {
+		return fmt.Errorf("ownership marker '%s' must not contain whitespace", c.OwnershipMarker)
+	}
+	if c.ProtectedAction != ProtectedActionSkip && c.ProtectedAction != ProtectedActionError {
+		return fmt.Errorf("unknown protected action '%s', must be one of '%s' or '%s'", c.ProtectedAction, ProtectedActionSkip, ProtectedActionError)
+	}
+	if c.MaxDeletes < 0 {
+		return fmt.Errorf("maximum deletes %d must not be negative", c.MaxDeletes)
+	}
+	if c.DeleteAllMinRecords < 0 {
+		return fmt.Errorf("minimum records %d before deleting all of them is refused must not be negative", c.DeleteAllMinRecords)
+	}
+	if c.MaxDeletePercent < 0 || c.MaxDeletePercent > 100 {
+		return fmt.Errorf("maximum delete percentage %g must be between 0 and 100", c.MaxDeletePercent)
+	}
+	if c.AuditLogMaxSize < 0 || c.AuditLogMaxBackups < 0 {
+		return fmt.Errorf("audit log maximum size %d and backups %d must not be negative", c.AuditLogMaxSize, c.AuditLogMaxBackups)
+	}
+	if _, err := newProtection(c); err != nil {
+		return err
+	}
+	if err := c.Notify.Validate(); err != nil {
+		return err
+	}
+	return nil
 }
 
 // DNSRecord represents a DNS record in the Opnsense Unbound API.
@@ -21,6 +135,59 @@ type DNSRecord struct {
 	MxPrio      string `json:"mxprio,omitempty"`
 }
 
+// record converts a host override into the Record the provider works with.
+func (r DNSRecord) record() Record {
+	return Record{
+		ID:          r.Uuid,
+		Name:        JoinUnboundFQDN(r.Hostname, r.Domain),
+		Type:        PruneUnboundType(r.Rr),
+		Target:      r.Server,
+		Enabled:     r.Enabled == "1",
+		Description: r.Description,
+	}
+}
+
+// hostOverride converts a Record into the host override Unbound keeps it as.
+func hostOverride(record Record) DNSRecord {
+	splitHost := SplitUnboundFQDN(record.Name)
+	r := DNSRecord{
+		Uuid:        record.ID,
+		Enabled:     "0",
+		Hostname:    splitHost[0],
+		Rr:          record.Type,
+		Server:      record.Target,
+		Description: record.Description,
+	}
+	if len(splitHost) > 1 {
+		r.Domain = splitHost[1]
+	}
+	if record.Enabled {
+		r.Enabled = "1"
+	}
+	return r
+}
+
+// DNSAlias is an alias of a host override as the Opnsense Unbound API returns it.
+type DNSAlias struct {
+	Uuid    string `json:"uuid"`
+	Enabled string `json:"enabled"`
+	// Host refers to the host override the alias belongs to, by its uuid
+	Host        string `json:"host"`
+	Hostname    string `json:"hostname"`
+	Domain      string `json:"domain"`
+	Description string `json:"description,omitempty"`
+}
+
+// unboundAliasList is returned when searching the aliases of host overrides
+type unboundAliasList struct {
+	Rows []DNSAlias `json:"rows"`
+}
+
+// Specific format for adding an alias through the Opnsense Unbound API
+type unboundAddHostAlias struct {
+	Alias DNSAlias `json:"alias"`
+}
+
 // unboundRecordsList is the main item returned from the Opnsense Unbound API
 // since it has some decorators we just throw this struct away
 type unboundRecordsList struct {
@@ -34,3 +201,11 @@ type unboundRecordsList struct {
 type unboundAddHostOverride struct {
 	Host DNSRecord `json:"host"`
 }
+
+// unboundSaveResult is returned by the Opnsense Unbound API after adding or setting a record
+type unboundSaveResult struct {
+	Result string `json:"result"`
+	UUID   string `json:"uuid,omitempty"`
+	// Validations maps the fields that failed validation to the reason, if the record wasn't saved
+	Validations map[string]string `json:"validations,omitempty"`
+}
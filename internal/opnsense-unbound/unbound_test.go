@@ -0,0 +1,180 @@
+package opnsense
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUnbound serves the parts of the Unbound API the client uses, keeping the host overrides and their aliases in memory.
+// It is meant for tests of the Unbound client, provider tests run against a MemoryBackend.
+type fakeUnbound struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	records map[string]DNSRecord
+	aliases map[string]DNSAlias
+	nextID  int
+	down    bool
+	// rejectSaves answers adds and sets with a failed validation, like OPNsense does with 200 OK
+	rejectSaves bool
+	// failAdds answers adds with 500 Internal Server Error
+	failAdds bool
+	// headers of every request served, in order
+	headers []http.Header
+}
+
+func newFakeUnbound(t *testing.T) *fakeUnbound {
+	t.Helper()
+	f := &fakeUnbound{records: make(map[string]DNSRecord), aliases: make(map[string]DNSAlias)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// setDown makes the fake drop every connection, like an unreachable firewall.
+func (f *fakeUnbound) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+// setRejectSaves makes the fake refuse to save records.
+func (f *fakeUnbound) setRejectSaves(reject bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejectSaves = reject
+}
+
+// setFailAdds makes the fake fail to add records with a server error.
+func (f *fakeUnbound) setFailAdds(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failAdds = fail
+}
+
+// addAlias holds alias, e.g. to name its host override by FQDN like some OPNsense versions do.
+func (f *fakeUnbound) addAlias(alias DNSAlias) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	alias.Uuid = fmt.Sprintf("uuid-%d", f.nextID)
+	f.aliases[alias.Uuid] = alias
+}
+
+// clear drops every record and alias, like a firewall set up from scratch.
+func (f *fakeUnbound) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.records)
+	clear(f.aliases)
+}
+
+// listAliases returns the held aliases sorted by name.
+func (f *fakeUnbound) listAliases() []DNSAlias {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var aliases []DNSAlias
+	for _, a := range f.aliases {
+		aliases = append(aliases, a)
+	}
+	slices.SortFunc(aliases, func(a, b DNSAlias) int {
+		return strings.Compare(a.Hostname+"."+a.Domain, b.Hostname+"."+b.Domain)
+	})
+	return aliases
+}
+
+// list returns the held records sorted by name and type.
+func (f *fakeUnbound) list() []DNSRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var records []DNSRecord
+	for _, r := range f.records {
+		records = append(records, r)
+	}
+	slices.SortFunc(records, func(a, b DNSRecord) int {
+		return strings.Compare(a.Hostname+"."+a.Domain+" "+a.Rr, b.Hostname+"."+b.Domain+" "+b.Rr)
+	})
+	return records
+}
+
+func (f *fakeUnbound) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		panic(http.ErrAbortHandler)
+	}
+	f.headers = append(f.headers, r.Header.Clone())
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/unbound/")
+	switch {
+	case path == "service/status":
+		fmt.Fprint(w, `{"status":"running"}`)
+	case path == "service/reconfigure":
+		fmt.Fprint(w, `{"status":"ok"}`)
+	case path == "settings/searchHostOverride":
+		rows := []DNSRecord{}
+		for _, record := range f.records {
+			rows = append(rows, record)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"rows": rows, "rowCount": len(rows)})
+	case f.failAdds && path == "settings/addHostOverride":
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	case f.rejectSaves && (path == "settings/addHostOverride" || strings.HasPrefix(path, "settings/setHostOverride/")):
+		fmt.Fprint(w, `{"result":"failed","validations":{"host.server":"A valid IP address must be specified."}}`)
+	case path == "settings/addHostOverride":
+		var body unboundAddHostOverride
+		json.NewDecoder(r.Body).Decode(&body)
+		f.nextID++
+		body.Host.Uuid = fmt.Sprintf("uuid-%d", f.nextID)
+		f.records[body.Host.Uuid] = body.Host
+		fmt.Fprintf(w, `{"result":"saved","uuid":%q}`, body.Host.Uuid)
+	case strings.HasPrefix(path, "settings/setHostOverride/"):
+		var body unboundAddHostOverride
+		json.NewDecoder(r.Body).Decode(&body)
+		body.Host.Uuid = strings.TrimPrefix(path, "settings/setHostOverride/")
+		f.records[body.Host.Uuid] = body.Host
+		fmt.Fprint(w, `{"result":"saved"}`)
+	case path == "settings/searchHostAlias":
+		rows := []DNSAlias{}
+		for _, alias := range f.aliases {
+			rows = append(rows, alias)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"rows": rows, "rowCount": len(rows)})
+	case path == "settings/addHostAlias":
+		var body unboundAddHostAlias
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := f.records[body.Alias.Host]; !ok {
+			fmt.Fprint(w, `{"result":"failed","validations":{"alias.host":"Option not in list."}}`)
+			return
+		}
+		f.nextID++
+		body.Alias.Uuid = fmt.Sprintf("uuid-%d", f.nextID)
+		f.aliases[body.Alias.Uuid] = body.Alias
+		fmt.Fprintf(w, `{"result":"saved","uuid":%q}`, body.Alias.Uuid)
+	case strings.HasPrefix(path, "settings/delHostOverride/"):
+		delete(f.records, strings.TrimPrefix(path, "settings/delHostOverride/"))
+		fmt.Fprint(w, `{"result":"deleted"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestCluster creates a cluster client for the fakes, retrying members right after they failed.
+func newTestCluster(t *testing.T, mode string, fakes ...*fakeUnbound) *clusterClient {
+	t.Helper()
+	config := &Config{HAMode: mode, Key: "key", Secret: "secret"}
+	for _, f := range fakes {
+		config.Hosts = append(config.Hosts, f.URL)
+	}
+	c, err := newClusterClient(config, clientOptions{target: DefaultTargetName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+// Package requestid carries the ID of a webhook request through its context,
+// so every log line written while serving it can be correlated.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Header is the HTTP header a request ID is read from and written to
+	Header = "X-Request-ID"
+	// LogField is the log field holding the request ID
+	LogField = "requestID"
+	// maxLength limits the length of request IDs accepted from clients
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Log returns a log entry with the request ID carried by ctx, if any
+func Log(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if id := FromContext(ctx); id != "" {
+		entry = entry.WithField(LogField, id)
+	}
+	return entry
+}
+
+// Middleware takes the request ID from the X-Request-ID header or generates a new one,
+// stores it in the request context and echoes it in the response
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if id == "" || len(id) > maxLength {
+			id = generate()
+		}
+
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+func generate() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("failed to generate request id: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
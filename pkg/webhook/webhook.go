@@ -2,9 +2,12 @@ package webhook
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 
+	"github.com/crutonjohn/external-dns-opnsense-webhook/internal/requestid"
 	log "github.com/sirupsen/logrus"
 
 	"sigs.k8s.io/external-dns/endpoint"
@@ -22,8 +25,24 @@ const (
 	logFieldError         = "error"
 )
 
+// unavailable is implemented by provider errors signalling that the backend
+// can't serve requests right now
+type unavailable interface {
+	Unavailable() bool
+}
+
+// errorStatus returns the status code reported to external-dns for a provider error
+func errorStatus(err error) int {
+	var u unavailable
+	if errors.As(err, &u) && u.Unavailable() {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 // Webhook for external dns provider
 type Webhook struct {
+	mu       sync.RWMutex
 	provider provider.Provider
 }
 
@@ -33,6 +52,23 @@ func New(provider provider.Provider) *Webhook {
 	return &p
 }
 
+// Provider returns the provider the webhook is serving
+func (p *Webhook) Provider() provider.Provider {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.provider
+}
+
+// SetProvider replaces the provider the webhook is serving and returns the previous one.
+// Requests already being served keep using the previous provider until they're done.
+func (p *Webhook) SetProvider(provider provider.Provider) provider.Provider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.provider
+	p.provider = provider
+	return previous
+}
+
 func (p *Webhook) contentTypeHeaderCheck(w http.ResponseWriter, r *http.Request) error {
 	return p.headerCheck(true, w, r)
 }
@@ -100,10 +136,10 @@ func (p *Webhook) Records(w http.ResponseWriter, r *http.Request) {
 
 	requestLog(r).Debug("requesting records")
 	ctx := r.Context()
-	records, err := p.provider.Records(ctx)
+	records, err := p.Provider().Records(ctx)
 	if err != nil {
 		requestLog(r).WithField(logFieldError, err).Error("error getting records")
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 
@@ -141,9 +177,10 @@ func (p *Webhook) ApplyChanges(w http.ResponseWriter, r *http.Request) {
 
 	requestLog(r).Debugf("requesting apply changes, create: %d , updateOld: %d, updateNew: %d, delete: %d",
 		len(changes.Create), len(changes.UpdateOld), len(changes.UpdateNew), len(changes.Delete))
-	if err := p.provider.ApplyChanges(ctx, &changes); err != nil {
+	if err := p.Provider().ApplyChanges(ctx, &changes); err != nil {
+		requestLog(r).WithField(logFieldError, err).Error("error applying changes")
 		w.Header().Set(contentTypeHeader, contentTypePlaintext)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -152,11 +189,11 @@ func (p *Webhook) ApplyChanges(w http.ResponseWriter, r *http.Request) {
 // AdjustEndpoints handles the post request for adjusting endpoints
 func (p *Webhook) AdjustEndpoints(w http.ResponseWriter, r *http.Request) {
 	if err := p.contentTypeHeaderCheck(w, r); err != nil {
-		log.Errorf("content type header check failed, request method: %s, request path: %s", r.Method, r.URL.Path)
+		requestLog(r).WithField(logFieldError, err).Error("content type header check failed")
 		return
 	}
 	if err := p.acceptHeaderCheck(w, r); err != nil {
-		log.Errorf("accept header check failed, request method: %s, request path: %s", r.Method, r.URL.Path)
+		requestLog(r).WithField(logFieldError, err).Error("accept header check failed")
 		return
 	}
 
@@ -166,23 +203,24 @@ func (p *Webhook) AdjustEndpoints(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 
 		errMessage := fmt.Sprintf("failed to decode request body: %v", err)
-		log.Infof(errMessage+" , request method: %s, request path: %s", r.Method, r.URL.Path)
+		requestLog(r).WithField(logFieldError, err).Info(errMessage)
 		if _, writeError := fmt.Fprint(w, errMessage); writeError != nil {
 			requestLog(r).WithField(logFieldError, writeError).Fatalf("error writing error message to response writer")
 		}
 		return
 	}
 
-	log.Debugf("requesting adjust endpoints count: %d", len(pve))
-	pve, err := p.provider.AdjustEndpoints(pve)
+	requestLog(r).Debugf("requesting adjust endpoints count: %d", len(pve))
+	pve, err := p.Provider().AdjustEndpoints(pve)
 	if err != nil {
+		requestLog(r).WithField(logFieldError, err).Error("error adjusting endpoints")
 		w.Header().Set(contentTypeHeader, contentTypePlaintext)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	out, _ := json.Marshal(&pve)
 
-	log.Debugf("return adjust endpoints response, resultEndpointCount: %d", len(pve))
+	requestLog(r).Debugf("return adjust endpoints response, resultEndpointCount: %d", len(pve))
 	w.Header().Set(contentTypeHeader, string(mediaTypeVersion1))
 	w.Header().Set(varyHeader, contentTypeHeader)
 	if _, writeError := fmt.Fprint(w, string(out)); writeError != nil {
@@ -196,9 +234,9 @@ func (p *Webhook) Negotiate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := p.provider.GetDomainFilter().MarshalJSON()
+	b, err := p.Provider().GetDomainFilter().MarshalJSON()
 	if err != nil {
-		log.Errorf("failed to marshal domain filter, request method: %s, request path: %s", r.Method, r.URL.Path)
+		requestLog(r).WithField(logFieldError, err).Error("failed to marshal domain filter")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -212,5 +250,5 @@ func (p *Webhook) Negotiate(w http.ResponseWriter, r *http.Request) {
 }
 
 func requestLog(r *http.Request) *log.Entry {
-	return log.WithFields(log.Fields{logFieldRequestMethod: r.Method, logFieldRequestPath: r.URL.Path})
+	return requestid.Log(r.Context()).WithFields(log.Fields{logFieldRequestMethod: r.Method, logFieldRequestPath: r.URL.Path})
 }